@@ -59,6 +59,69 @@ func (s *Shape) NormalDir(point Vec3) Vec3 {
 	panic("unreachable")
 }
 
+// Returns the center and radius of a sphere enclosing the shape.
+// Planes are unbounded and report an infinite radius.
+func (s *Shape) BoundingSphere() (Vec3, Float) {
+	switch s.kind {
+	case kindSphere:
+		return s.Position, s.radius
+	case kindPlane:
+		return s.Position, positiveInfinity
+	case kindCube:
+		return s.Position, s.radius * Float(math.Sqrt(3))
+	}
+	panic("unreachable")
+}
+
+// Returns the surface area of the shape
+func (s *Shape) Area() Float {
+	switch s.kind {
+	case kindSphere:
+		return 4 * pi * s.radius * s.radius
+	case kindPlane:
+		return positiveInfinity
+	case kindCube:
+		return 24 * s.radius * s.radius
+	}
+	panic("unreachable")
+}
+
+// Returns a point distributed uniformly over the surface of the shape and
+// the outward normal there, given three uniform random numbers in [0, 1).
+// Planes are unbounded and can't be sampled.
+func (s *Shape) SampleSurface(r1, r2, r3 float64) (Vec3, Vec3) {
+	switch s.kind {
+	case kindSphere:
+		z := 1 - 2*r1
+		r := math.Sqrt(math.Max(0, 1-z*z))
+		phi := 2 * math.Pi * r2
+		normal := Vec3{Float(r * math.Cos(phi)), Float(r * math.Sin(phi)), Float(z)}
+		return s.Position.Add(normal.Mult(s.radius)), normal
+	case kindCube:
+		// All faces have the same area
+		face := int(r3 * 6)
+		if face > 5 {
+			face = 5
+		}
+		u, v := s.radius*Float(2*r1-1), s.radius*Float(2*r2-1)
+		sign := Float(1)
+		if face%2 == 0 {
+			sign = -1
+		}
+		var offset, normal Vec3
+		switch face / 2 {
+		case 0:
+			offset, normal = Vec3{sign * s.radius, u, v}, Vec3{sign, 0, 0}
+		case 1:
+			offset, normal = Vec3{u, sign * s.radius, v}, Vec3{0, sign, 0}
+		case 2:
+			offset, normal = Vec3{u, v, sign * s.radius}, Vec3{0, 0, sign}
+		}
+		return s.Position.Add(offset), normal
+	}
+	panic("Can't sample the surface of an unbounded shape")
+}
+
 var positiveInfinity = Float(math.Inf(+1))
 
 const pi = Float(math.Pi)
@@ -11,16 +11,18 @@ type Scene struct {
 	Camera        Ray
 	Near          Float
 	PixW, PixH    Float
+	Sky           *Sky
 }
 
 func ParseScene(filename string, width, height, fov Float, cols, rows int) Scene {
 	var shapes []*Shape
 
-	// light source
+	// light source, as strong as it takes the default render to be about as
+	// bright as it was before the lighting was normalised by pi
 	shapes = append(shapes, Sphere(
 		1,                // radius
 		Vec3{-4, 0, -10}, // position
-		Vec3{2, 2, 2},    // emission
+		Vec3{50, 50, 50}, // emission
 		Vec3{1, 1, 1},    // colour
 		DIFFUSE,          // material
 	))
@@ -122,5 +124,29 @@ func ParseScene(filename string, width, height, fov Float, cols, rows int) Scene
 	return Scene{width, height, rows, cols, shapes,
 		Ray{camera, Vec3{0, 0, -1}}, near,
 		2 * height / Float(rows),
-		2 * width / Float(cols)}
+		2 * width / Float(cols), nil}
+}
+
+// Returns a sphere enclosing the camera and every bounded shape in the
+// scene. Infinite planes are ignored.
+func (s *Scene) Bounds() (center Vec3, radius Float) {
+	min, max := s.Camera.Origin, s.Camera.Origin
+	for _, shape := range s.Objects {
+		if shape.kind == kindPlane {
+			continue
+		}
+		for _, corner := range []Vec3{
+			shape.Position.Sub(Vec3{shape.radius, shape.radius, shape.radius}),
+			shape.Position.Add(Vec3{shape.radius, shape.radius, shape.radius}),
+		} {
+			min = Vec3{Float(math.Min(float64(min.X), float64(corner.X))),
+				Float(math.Min(float64(min.Y), float64(corner.Y))),
+				Float(math.Min(float64(min.Z), float64(corner.Z)))}
+			max = Vec3{Float(math.Max(float64(max.X), float64(corner.X))),
+				Float(math.Max(float64(max.Y), float64(corner.Y))),
+				Float(math.Max(float64(max.Z), float64(corner.Z)))}
+		}
+	}
+	center = min.Add(max).Mult(0.5)
+	return center, max.Distance(center)
 }
@@ -0,0 +1,152 @@
+package geometry
+
+import (
+	"math"
+)
+
+/////////////////////////
+// Sun and sky
+/////////////////////////
+
+// Sky is an analytic daylight model after Preetham, Shirley and Smits,
+// "A Practical Analytic Model for Daylight" (1999). The sky dome is
+// infinitely far away and lights every ray that leaves the scene, while
+// the sun is a small directional light that is paired with it.
+type Sky struct {
+	Sun       Vec3  // Unit vector pointing towards the sun
+	Turbidity Float // Haziness of the atmosphere, 2 is very clear, 10 is hazy
+	Intensity Float // Scale from kcd/m² to scene units
+
+	// Irradiance from the sun on a surface facing it and the
+	// cosine of the sun's angular radius as seen from the ground
+	SunIrradiance Vec3
+	SunCosAngle   Float
+
+	thetaSun float64
+	zenith   [3]float64 // Y, x, y at the zenith
+	perez    [3][5]float64
+}
+
+// The sun's angular radius in radians as seen from the earth
+const SunAngularRadius = 0.00465
+
+// Creates a new sky with the sun at the given elevation above the horizon
+// and azimuth around the Y axis, both in radians. An azimuth of zero puts
+// the sun towards -Z, looking into the scene.
+func NewSky(elevation, azimuth, turbidity, intensity Float) *Sky {
+	cosElevation := Float(math.Cos(float64(elevation)))
+	sun := Vec3{
+		cosElevation * Float(math.Sin(float64(azimuth))),
+		Float(math.Sin(float64(elevation))),
+		-cosElevation * Float(math.Cos(float64(azimuth))),
+	}.Normalize()
+
+	sky := &Sky{
+		Sun:         sun,
+		Turbidity:   turbidity,
+		Intensity:   intensity,
+		SunCosAngle: Float(math.Cos(SunAngularRadius)),
+		thetaSun:    math.Acos(math.Min(1, float64(sun.Y))),
+	}
+
+	T := float64(turbidity)
+	sky.perez = [3][5]float64{
+		{0.1787*T - 1.4630, -0.3554*T + 0.4275, -0.0227*T + 5.3251, 0.1206*T - 2.5771, -0.0670*T + 0.3703},
+		{-0.0193*T - 0.2592, -0.0665*T + 0.0008, -0.0004*T + 0.2125, -0.0641*T - 0.8989, -0.0033*T + 0.0452},
+		{-0.0167*T - 0.2608, -0.0950*T + 0.0092, -0.0079*T + 0.2102, -0.0441*T - 1.6537, -0.0109*T + 0.0529},
+	}
+
+	theta := sky.thetaSun
+	chi := (4.0/9.0 - T/120.0) * (math.Pi - 2*theta)
+	sky.zenith[0] = (4.0453*T-4.9710)*math.Tan(chi) - 0.2155*T + 2.4192
+
+	thetas := [4]float64{theta * theta * theta, theta * theta, theta, 1}
+	zenithX := [3][4]float64{
+		{0.00166, -0.00375, 0.00209, 0},
+		{-0.02903, 0.06377, -0.03202, 0.00394},
+		{0.11693, -0.21196, 0.06052, 0.25886},
+	}
+	zenithY := [3][4]float64{
+		{0.00275, -0.00610, 0.00317, 0},
+		{-0.04214, 0.08970, -0.04153, 0.00516},
+		{0.15346, -0.26756, 0.06670, 0.26688},
+	}
+	turbidities := [3]float64{T * T, T, 1}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			sky.zenith[1] += turbidities[i] * zenithX[i][j] * thetas[j]
+			sky.zenith[2] += turbidities[i] * zenithY[i][j] * thetas[j]
+		}
+	}
+
+	sky.SunIrradiance = sky.sunTransmittance().Mult(solarIlluminance * intensity)
+	return sky
+}
+
+// The illuminance of the sun outside of the atmosphere in klx
+const solarIlluminance = 127
+
+func (s *Sky) perezFunction(coefficients [5]float64, cosTheta, gamma, cosGamma float64) float64 {
+	A, B, C, D, E := coefficients[0], coefficients[1], coefficients[2], coefficients[3], coefficients[4]
+	return (1 + A*math.Exp(B/cosTheta)) * (1 + C*math.Exp(D*gamma) + E*cosGamma*cosGamma)
+}
+
+// Returns the radiance of the sky dome seen along direction, excluding
+// the sun itself. Directions below the horizon see the horizon colour.
+func (s *Sky) Radiance(direction Vec3) Vec3 {
+	const horizon = 0.01
+	direction = direction.Normalize()
+	if direction.Y < horizon {
+		direction.Y = horizon
+		direction = direction.Normalize()
+	}
+
+	cosTheta := float64(direction.Y)
+	cosGamma := math.Max(-1, math.Min(1, float64(direction.Dot(s.Sun))))
+	gamma := math.Acos(cosGamma)
+	cosThetaSun := math.Cos(s.thetaSun)
+
+	var xyY [3]float64
+	for i := 0; i < 3; i++ {
+		sky := s.perezFunction(s.perez[i], cosTheta, gamma, cosGamma)
+		zenith := s.perezFunction(s.perez[i], 1, s.thetaSun, cosThetaSun)
+		xyY[i] = s.zenith[i] * sky / zenith
+	}
+
+	return xyYToRGB(xyY[1], xyY[2], xyY[0]).Mult(s.Intensity)
+}
+
+// Returns the fraction of sunlight that reaches the ground for red, green
+// and blue light, accounting for Rayleigh and aerosol scattering along
+// the path through the atmosphere.
+func (s *Sky) sunTransmittance() Vec3 {
+	degrees := s.thetaSun * 180 / math.Pi
+	if degrees > 93 {
+		return Vec3{}
+	}
+	mass := 1 / (math.Cos(s.thetaSun) + 0.15*math.Pow(93.885-degrees, -1.253))
+
+	beta := 0.04608*float64(s.Turbidity) - 0.04586
+	const alpha = 1.3
+	transmittance := func(lambda float64) Float {
+		rayleigh := math.Exp(-0.008735 * math.Pow(lambda, -4.08) * mass)
+		aerosol := math.Exp(-beta * math.Pow(lambda, -alpha) * mass)
+		return Float(rayleigh * aerosol)
+	}
+	// Wavelengths in µm representative for red, green and blue
+	return Vec3{transmittance(0.65), transmittance(0.57), transmittance(0.475)}
+}
+
+// Converts CIE xyY chromaticity and luminance to linear sRGB
+func xyYToRGB(x, y, Y float64) Vec3 {
+	if y <= 0 {
+		return Vec3{}
+	}
+	X := x / y * Y
+	Z := (1 - x - y) / y * Y
+	return Vec3{
+		Float(math.Max(0, 3.2406*X-1.5372*Y-0.4986*Z)),
+		Float(math.Max(0, -0.9689*X+1.8758*Y+0.0415*Z)),
+		Float(math.Max(0, 0.0557*X-0.2040*Y+1.0570*Z)),
+	}
+}
@@ -98,6 +98,19 @@ func (v Vec3) Distance2(other Vec3) Float {
 	return dx*dx + dy*dy + dz*dz
 }
 
+// Returns two unit vectors that together with v form an orthonormal basis.
+// v is expected to be normalized.
+func (v Vec3) Basis() (Vec3, Vec3) {
+	var helper Vec3
+	if math.Abs(float64(v.X)) > 0.9 {
+		helper = Vec3{0, 1, 0}
+	} else {
+		helper = Vec3{1, 0, 0}
+	}
+	u := helper.Cross(v).Normalize()
+	return u, v.Cross(u)
+}
+
 /////////////////////////
 // Ugly util functions
 /////////////////////////
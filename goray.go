@@ -5,29 +5,86 @@ import (
 	"fmt"
 	"github.com/Nightgunner5/goray/geometry"
 	"github.com/Nightgunner5/goray/gorender"
+	"github.com/Nightgunner5/goray/hdr"
+	"github.com/Nightgunner5/goray/ldr"
+	"image"
+	"image/jpeg"
 	"image/png"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
 	input    = new(string) //flag.String("in", "default", "The file describing the scene")
 	cores    = flag.Int("cores", 2, "The number of cores to use on the machine")
-	chunks   = flag.Int("chunks", 8, "The number of chunks to use for parallelism")
+	tileSize = flag.Int("tilesize", 32, "The width and height in pixels of the tiles the image is rendered in")
+	filter   = flag.String("filter", "box", "The reconstruction filter weighting the samples of every pixel, one of: "+strings.Join(gorender.FilterNames(), ", "))
+	filterR  = flag.Float64("filterradius", 0, "The radius of the reconstruction filter in pixels, 0 for the usual radius of the filter")
+	tiles    = flag.String("tileorder", "spiral", "The order tiles are rendered in, one of: "+strings.Join(gorender.TileOrderNames(), ", "))
 	fov      = flag.Int("fov", 90, "The field of view of the rendered image")
 	cols     = flag.Int("w", 800, "The width in pixels of the rendered image")
 	rows     = flag.Int("h", 600, "The height in pixels of the rendered image")
 	seed     = flag.Int64("seed", 1, "The seed for the random number generator")
-	output   = flag.String("out", "out.png", "Output file for the rendered scene")
-	bloom    = flag.Int("bloom", 10, "The number of iteration to run the bloom filter")
-	mindepth = flag.Int("depth", 2, "The minimum recursion depth used for the rays")
-	rays     = flag.Int("rays", 10, "The number of rays used to sample each pixel")
-	//caustics = flag.Int("caustics", 256, "The depth of the caustic photon tracing before the render")
-	gamma = flag.Float64("gamma", 2.2, "The factor to use for gamma correction")
+	output   = flag.String("out", "out.png", "Output file for the rendered scene, - for stdout, .exr, .hdr and .pfm files hold linear colours")
+	format   = flag.String("format", "", "The format of the output, one of: "+strings.Join(formatNames(), ", ")+", by default chosen by the extension of the output file or png for stdout")
+	quality  = flag.Int("quality", 90, "The quality of JPEG images from 1 to 100")
+	exrFloat = flag.Bool("exrfloat", false, "Write 32 bit floats to .exr files instead of 16 bit halves")
+	exrZip   = flag.Bool("exrzip", true, "Compress .exr files with zip")
+	bloom    = flag.Int("bloom", 6, "The number of levels of the bloom filter, each doubles the size of the glow, 0 disables it")
+	bloomT   = flag.Float64("bloomthreshold", 1, "The brightness above which light glows, after exposure")
+	bloomI   = flag.Float64("bloomintensity", 0.2, "The part of the light above the bloom threshold that is spread into the glow")
+	post     = flag.String("post", "bloom", "The post processes run in order after exposure, any of: "+strings.Join(gorender.PostProcessNames(), ", ")+". grade and lut work on the tone mapped, display encoded colours and must come last")
+	vignette = flag.Float64("vignette", 0.3, "The darkening of the corners by the vignette post process")
+	chroma   = flag.Float64("chromatic", 0.005, "The part of the distance from the centre by which the chromatic post process spreads red and blue, between -1 and 1")
+	sharpen  = flag.Float64("sharpen", 0.5, "The strength of the sharpen post process")
+	lift     = flag.String("lift", "0", "The lift of the grade post process as one value or r,g,b, raising the blacks")
+	gradeG   = flag.String("gradegamma", "1", "The gamma of the grade post process as one value or r,g,b, brightening the midtones above 1")
+	gain     = flag.String("gain", "1", "The gain of the grade post process as one value or r,g,b, scaling the whites")
+	satur    = flag.Float64("saturation", 1, "The saturation of the grade post process, 0 is grey")
+	lut      = flag.String("lut", "", "The .cube file applied by the lut post process, which expects display encoded colours from 0 to 1")
+	denoise  = flag.Int("denoise", 0, "The number of passes of the denoiser, 5 is a good start and 0 disables it")
+	aovs     = flag.Bool("aovs", false, "Write the depth, normal, albedo, emission, object and material seen by every pixel and its samples next to the output file")
+	passes   = flag.Bool("passes", false, "Write the image split into emission, direct and indirect diffuse, specular and transmission passes next to the output file")
+	lightBuf = flag.Bool("lights", false, "Write the light of every emitter and light group next to the output file")
+	groups   = flag.String("lightgroups", "", "The light groups written by -lights as name=objects, like key=1,fill=3+4, objects count from 1 and 0 is the sky")
+	mindepth = flag.Int("depth", 2, "The depth after which paths are ended by russian roulette")
+	maxdepth = flag.Int("maxdepth", 16, "The maximum number of bounces of a path")
+	rays     = flag.Int("rays", 10, "The number of rays used to sample each pixel, the minimum with adaptive sampling")
+	maxRays  = flag.Int("maxrays", 0, "The maximum number of rays per pixel with adaptive sampling, adaptive sampling is off if not above rays and takes at least 2 rays per pixel")
+	adaptive = flag.Float64("threshold", 0.05, "The relative error of a pixel's brightness at which adaptive sampling stops")
+	lights   = flag.Int("lightsamples", 1, "The number of lights sampled at every diffuse hit")
+	method   = flag.String("integrator", "path", "The rendering algorithm, one of: "+strings.Join(gorender.IntegratorNames(), ", "))
+	sampler  = flag.String("sampler", "independent", "The source of random numbers for pixel samples, one of: "+strings.Join(gorender.SamplerNames(), ", "))
+	aoRange  = flag.Float64("aodistance", 2, "The distance within which geometry occludes in the ao integrator")
+	photons  = flag.Int("photons", 100000, "The number of photons traced from every light for the photon map")
+	gather   = flag.Int("gather", 32, "The number of nearest photons used to estimate indirect light, 0 disables the photon map")
+	gatherR  = flag.Float64("gatherradius", 0.5, "The largest distance to search for photons")
+	caustics = flag.Int("caustics", 100000, "The number of caustic photons sent from every light, 0 disables caustics")
+	cGather  = flag.Int("causticgather", 32, "The number of nearest caustic photons used to estimate focused light")
+	cRadius  = flag.Float64("causticradius", 0.2, "The largest distance to search for caustic photons")
+	gamma    = flag.Float64("gamma", 2.2, "The factor to use for gamma correction with the gamma transfer function")
+	transfer = flag.String("transfer", "srgb", "The transfer function encoding colours for display, one of: "+strings.Join(gorender.TransferFunctionNames(), ", "))
+	bits     = flag.Int("bits", 8, "The bits per channel of PNG images, 8 or 16")
+	dither   = flag.Bool("dither", true, "Dither 8 bit images to avoid banding")
+	toneMap  = flag.String("tonemap", "linear", "The tone mapping operator, one of: "+strings.Join(gorender.ToneMapperNames(), ", "))
+	exposure = flag.Float64("exposure", 0, "The exposure in stops, every stop doubles the brightness")
+	white    = flag.Float64("white", 4, "The brightness that the reinhard tone mapper maps to white")
+
+	sky          = flag.Bool("sky", false, "Light the scene with an analytic sun and sky")
+	sunElevation = flag.Float64("sunelevation", 45, "The elevation of the sun above the horizon in degrees")
+	sunAzimuth   = flag.Float64("sunazimuth", 0, "The azimuth of the sun in degrees, 0 is straight ahead")
+	turbidity    = flag.Float64("turbidity", 2.5, "The turbidity of the atmosphere, from 2 (clear) to 10 (hazy)")
+	skyIntensity = flag.Float64("skyintensity", 0.1, "The factor converting sky luminance in kcd/m² to scene units")
 
 	skipTop    = flag.Int("skiptop", 0, "The number of pixels to skip calculating starting from the top of the image")
 	skipLeft   = flag.Int("skipleft", 0, "The number of pixels to skip calculating starting from the left side of the image")
@@ -39,22 +96,175 @@ var (
 	memprofile = flag.String("memprofile", "", "Write memory profile informaion to file")
 )
 
+// The encoders of display referred images by format
+var encoders = map[string]func(io.Writer, image.Image) error{
+	"bmp": ldr.EncodeBMP,
+	"jpeg": func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: *quality})
+	},
+	"png":  png.Encode,
+	"ppm":  ldr.EncodePPM,
+	"tiff": ldr.EncodeTIFF,
+}
+
+// Formats of linear colours, written by writeFrame itself
+var hdrFormats = map[string]bool{"exr": true, "hdr": true, "pfm": true}
+
+// Returns the names of all output formats in alphabetical order
+func formatNames() []string {
+	var names []string
+	for name := range hdrFormats {
+		names = append(names, name)
+	}
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the format of the output file from -format or the extension of
+// -out, jpg and tif standing for jpeg and tiff
+func outputFormat() string {
+	if *format != "" {
+		return *format
+	}
+	if *output == "-" {
+		return "png"
+	}
+	switch extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(*output), ".")); extension {
+	case "jpg":
+		return "jpeg"
+	case "tif":
+		return "tiff"
+	default:
+		return extension
+	}
+}
+
 func main() {
 	flag.Parse()
 
+	// With the image going to stdout, everything else goes to stderr
+	imageOut := os.Stdout
+	if *output == "-" {
+		os.Stdout = os.Stderr
+	}
+
 	rand.Seed(*seed)
 
 	gorender.Config.NumRays = *rays
-	//gorender.Config.Caustics = *caustics
+	gorender.Config.MaxRays = *maxRays
+	gorender.Config.AdaptiveThreshold = *adaptive
+	gorender.Config.LightSamples = *lights
+	gorender.Config.Integrator = *method
+	gorender.Config.Sampler = *sampler
+	gorender.Config.AODistance = *aoRange
+	gorender.Config.Photons = *photons
+	gorender.Config.PhotonGather = *gather
+	gorender.Config.GatherRadius = *gatherR
+	gorender.Config.Caustics = *caustics
+	gorender.Config.CausticGather = *cGather
+	gorender.Config.CausticRadius = *cRadius
 	gorender.Config.BloomFactor = *bloom
+	gorender.Config.BloomThreshold = *bloomT
+	gorender.Config.BloomIntensity = *bloomI
+	gorender.Config.Vignette = *vignette
+	gorender.Config.ChromaticAberration = *chroma
+	gorender.Config.Sharpen = *sharpen
+	gorender.Config.Lift = parseColour("lift", *lift)
+	gorender.Config.Gamma = parseColour("gradegamma", *gradeG)
+	gorender.Config.Gain = parseColour("gain", *gain)
+	gorender.Config.Saturation = *satur
+	gorender.Config.LUT = *lut
+	gorender.Config.Denoise = *denoise
+	gorender.Config.AOVs = *aovs
+	gorender.Config.Passes = *passes
+	gorender.Config.LightBuffers = *lightBuf || *groups != ""
+	gorender.Config.LightGroups = parseLightGroups(*groups)
 	gorender.Config.MinDepth = *mindepth
+	gorender.Config.MaxDepth = *maxdepth
 	gorender.Config.GammaFactor = *gamma
+	gorender.Config.Transfer = *transfer
+	gorender.Config.Bits = *bits
+	gorender.Config.Dither = *dither
+	gorender.Config.ToneMapper = *toneMap
+	gorender.Config.Exposure = *exposure
+	gorender.Config.WhitePoint = *white
+
+	gorender.Config.TileSize = *tileSize
+	gorender.Config.TileOrder = *tiles
+	gorender.Config.Filter = *filter
+	gorender.Config.FilterRadius = *filterR
 
 	gorender.Config.Skip.Top = *skipTop
 	gorender.Config.Skip.Left = *skipLeft
 	gorender.Config.Skip.Right = *skipRight
 	gorender.Config.Skip.Bottom = *skipBottom
 
+	if _, ok := gorender.Integrators[*method]; !ok {
+		log.Fatalf("Unknown integrator %q, expected one of: %v", *method, strings.Join(gorender.IntegratorNames(), ", "))
+	}
+	if _, ok := gorender.Samplers[*sampler]; !ok {
+		log.Fatalf("Unknown sampler %q, expected one of: %v", *sampler, strings.Join(gorender.SamplerNames(), ", "))
+	}
+	if _, ok := gorender.TransferFunctions[*transfer]; !ok {
+		log.Fatalf("Unknown transfer function %q, expected one of: %v", *transfer, strings.Join(gorender.TransferFunctionNames(), ", "))
+	}
+	if _, ok := gorender.TileOrders[*tiles]; !ok {
+		log.Fatalf("Unknown tile order %q, expected one of: %v", *tiles, strings.Join(gorender.TileOrderNames(), ", "))
+	}
+	if _, ok := gorender.Filters[*filter]; !ok {
+		log.Fatalf("Unknown filter %q, expected one of: %v", *filter, strings.Join(gorender.FilterNames(), ", "))
+	}
+	if *gatherR <= 0 || *cRadius <= 0 {
+		log.Fatalf("The gather radii must be positive, not %v and %v", *gatherR, *cRadius)
+	}
+	if *tileSize < 1 {
+		log.Fatalf("Tiles must be at least 1 pixel wide, not %v", *tileSize)
+	}
+	if *bits != 8 && *bits != 16 {
+		log.Fatalf("Images can have 8 or 16 bits per channel, not %v", *bits)
+	}
+	if _, ok := gorender.ToneMappers[*toneMap]; !ok {
+		log.Fatalf("Unknown tone mapper %q, expected one of: %v", *toneMap, strings.Join(gorender.ToneMapperNames(), ", "))
+	}
+	outFormat := outputFormat()
+	if _, ok := encoders[outFormat]; !ok && !hdrFormats[outFormat] {
+		log.Fatalf("Unknown output format %q, expected one of: %v", outFormat, strings.Join(formatNames(), ", "))
+	}
+	if *output == "-" && outFormat != "exr" && (*aovs || *passes || gorender.Config.LightBuffers) {
+		log.Fatal("AOVs, passes and light groups can only be written to stdout as OpenEXR layers")
+	}
+	if *output != "-" {
+		// The directory must exist for the temporary file
+		if info, err := os.Stat(filepath.Dir(*output)); err != nil || !info.IsDir() {
+			log.Fatalf("Can't write %v, its directory doesn't exist", *output)
+		}
+	}
+	if *quality < 1 || *quality > 100 {
+		log.Fatalf("The JPEG quality must be from 1 to 100, not %v", *quality)
+	}
+	// Red and blue are spread by dividing by 1 plus and 1 minus the shift
+	if math.Abs(*chroma) >= 1 {
+		log.Fatalf("The chromatic aberration must be between -1 and 1, not %v", *chroma)
+	}
+	var postNames []string
+	if *post != "" {
+		postNames = strings.Split(*post, ",")
+	}
+	for _, name := range postNames {
+		if _, ok := gorender.PostProcesses[name]; !ok {
+			log.Fatalf("Unknown post process %q, expected any of: %v", name, strings.Join(gorender.PostProcessNames(), ", "))
+		}
+	}
+	// Loads the LUT now rather than failing after the render
+	linear, display, err := gorender.NewPostProcessing(postNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gorender.Config.PostProcessing, gorender.Config.DisplayProcessing = linear, display
+
 	wantedCPUs := *cores
 	if wantedCPUs < 1 {
 		wantedCPUs = 1
@@ -62,15 +272,7 @@ func main() {
 	fmt.Printf("Running on %v/%v CPU cores\n", wantedCPUs, runtime.NumCPU())
 	runtime.GOMAXPROCS(wantedCPUs)
 
-	if wantedCPUs > *chunks {
-		log.Print("Warning: chunks setting is lower than the number of cores - not all cores will be used")
-	}
-
-	if *rows%*chunks != 0 {
-		log.Fatal("The images height needs to be evenly divisible by chunks")
-	}
-
-	gorender.Config.Chunks = *chunks
+	gorender.Config.Workers = wantedCPUs
 
 	if *cpuprofile != "" {
 		cpupf, err := os.Create(*cpuprofile)
@@ -88,11 +290,6 @@ func main() {
 		runtime.MemProfileRate = 0
 	}
 
-	file, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	fmt.Printf("Rendering %vx%v sized image with %v rays per pixel to %v\n", *cols, *rows, *rays, *output)
 
 	// "Real world" frustrum
@@ -101,9 +298,16 @@ func main() {
 	angle := math.Pi * geometry.Float(*fov) / 180.0
 
 	scene := geometry.ParseScene(*input, width, height, angle, *cols, *rows)
-	img := gorender.Render(scene)
+	if *sky {
+		scene.Sky = geometry.NewSky(
+			geometry.Float(*sunElevation*math.Pi/180),
+			geometry.Float(*sunAzimuth*math.Pi/180),
+			geometry.Float(*turbidity),
+			geometry.Float(*skyIntensity))
+	}
+	frame := gorender.Render(scene)
 
-	if err = png.Encode(file, img); err != nil {
+	if err := writeOutput(imageOut, frame, outFormat); err != nil {
 		log.Fatal(err)
 	}
 
@@ -116,3 +320,141 @@ func main() {
 		defer mempf.Close()
 	}
 }
+
+// Writes frame to stdout, or to the output file and the AOVs to files next
+// to it
+func writeOutput(stdout *os.File, frame *gorender.Frame, format string) error {
+	if *output == "-" {
+		return writeFrame(stdout, frame, format)
+	}
+	err := writeFile(*output, func(w io.Writer) error {
+		return writeFrame(w, frame, format)
+	})
+	if err == nil && frame.AOVs != nil && format != "exr" {
+		err = writeAOVs(frame, format)
+	}
+	return err
+}
+
+// Writes filename through a temporary file next to it that replaces it
+// once it is complete
+func writeFile(filename string, write func(w io.Writer) error) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	if err = write(file); err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Writes frame in the given format. OpenEXR files hold the AOVs as layers,
+// other formats leave them to writeAOVs.
+func writeFrame(w io.Writer, frame *gorender.Frame, format string) error {
+	switch format {
+	case "exr":
+		img := frame.HDR()
+		if frame.AOVs != nil {
+			frame.AOVs.AddChannels(img)
+		}
+		pixelType, compression := hdr.Half, hdr.NoCompression
+		if *exrFloat {
+			pixelType = hdr.Float
+		}
+		if *exrZip {
+			compression = hdr.ZipCompression
+		}
+		return hdr.EncodeEXR(w, img, pixelType, compression)
+	case "hdr":
+		return hdr.EncodeRGBE(w, frame.HDR())
+	case "pfm":
+		return hdr.EncodePFM(w, frame.HDR())
+	}
+	return encoders[format](w, frame.Image)
+}
+
+// Parses light groups like key=1,fill=3+4 into the objects of each group
+func parseLightGroups(groups string) map[string][]int {
+	result := make(map[string][]int)
+	if groups == "" {
+		return result
+	}
+	for _, group := range strings.Split(groups, ",") {
+		parts := strings.SplitN(group, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Light group %q is not of the form name=objects", group)
+		}
+		for _, object := range strings.Split(parts[1], "+") {
+			index, err := strconv.Atoi(object)
+			if err != nil || index < 0 {
+				log.Fatalf("Light group %q has an invalid object %q", parts[0], object)
+			}
+			result[parts[0]] = append(result[parts[0]], index)
+		}
+	}
+	return result
+}
+
+// Parses a colour given as one value for every channel or as r,g,b
+func parseColour(name, colour string) geometry.Vec3 {
+	parts := strings.Split(colour, ",")
+	if len(parts) == 1 {
+		parts = []string{parts[0], parts[0], parts[0]}
+	}
+	var values [3]geometry.Float
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || len(parts) != 3 {
+			log.Fatalf("The %v %q is not one value or r,g,b", name, colour)
+		}
+		values[i] = geometry.Float(value)
+	}
+	return geometry.Vec3{values[0], values[1], values[2]}
+}
+
+// Writes every AOV, pass and light group of frame to a file named after the
+// output file, out_depth.png for out.png. Radiance HDR and PFM outputs get
+// linear files in their own format, the others PNGs.
+func writeAOVs(frame *gorender.Frame, format string) error {
+	ext := filepath.Ext(*output)
+	base := strings.TrimSuffix(*output, ext)
+	if format == "hdr" || format == "pfm" {
+		img := hdr.NewImage(len(frame.Colours[0]), len(frame.Colours))
+		frame.AOVs.AddChannels(img)
+		for name, layer := range img.Layers() {
+			err := writeFile(base+"_"+name+ext, func(w io.Writer) error {
+				if format == "hdr" {
+					return hdr.EncodeRGBE(w, layer)
+				}
+				return hdr.EncodePFM(w, layer)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if frame.AOVs.Depth != nil {
+		fmt.Printf("Depth AOV is scaled to %v scene units\n", frame.AOVs.MaxDepth())
+	}
+	for name, img := range frame.AOVs.Images() {
+		err := writeFile(base+"_"+name+".png", func(w io.Writer) error {
+			return png.Encode(w, img)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"github.com/Nightgunner5/goray/hdr"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+)
+
+//////////////////////////////////
+// Arbitrary output variables
+//////////////////////////////////
+
+// AOVs hold the first surfaces hit by the camera samples of every pixel,
+// weighted by the filter like the image, for compositing and external
+// denoisers. Object is the index of the shape in the scene plus one and
+// Material its material, both taken from the sample weighted most and
+// zero where it hit nothing. Depth is the mean distance to the first hit
+// of the samples that hit something. Passes hold the image split by light
+// path and Lights by the light group named by LightGroups, both before the
+// image is denoised. Samples holds the number of samples the film took in
+// every pixel and Variance the variance of their mean luminance. Buffers
+// that weren't collected are nil.
+type AOVs struct {
+	Depth    [][]geometry.Float
+	Normal   [][]geometry.Vec3
+	Albedo   [][]geometry.Vec3
+	Emission [][]geometry.Vec3
+	Object   [][]int
+	Material [][]int
+	Passes   [][]Passes
+
+	LightGroups []string
+	Lights      [][][]geometry.Vec3
+
+	Samples  [][]int
+	Variance [][]float64
+}
+
+// The first surface hit by a camera sample, or the weighted sum of those
+// of the samples of a pixel. The depth is summed over the samples that hit
+// something, whose weights add up to hits. Object and material come from
+// the sample with the strongest weight.
+type aovPixel struct {
+	depth, hits              geometry.Float
+	normal, albedo, emission geometry.Vec3
+	object, material         int
+	strongest                geometry.Float
+}
+
+// Records shape, hit at distance with the given normal, as the first
+// surface of a sample
+func (p *aovPixel) record(scene *geometry.Scene, shape *geometry.Shape, distance geometry.Float, normal geometry.Vec3) {
+	p.depth, p.hits = distance, 1
+	p.normal, p.albedo, p.emission = normal, shape.Colour, shape.Emission
+	p.material = shape.Material
+	for i, object := range scene.Objects {
+		if object == shape {
+			p.object = i + 1
+		}
+	}
+}
+
+func (p *aovPixel) add(sample *aovPixel, weight geometry.Float) {
+	p.depth += sample.depth * weight
+	p.hits += sample.hits * weight
+	p.normal.AddInPlace(sample.normal.Mult(weight))
+	p.albedo.AddInPlace(sample.albedo.Mult(weight))
+	p.emission.AddInPlace(sample.emission.Mult(weight))
+	if strongest := sample.strongest * weight; strongest > p.strongest {
+		p.object, p.material, p.strongest = sample.object, sample.material, strongest
+	}
+}
+
+// Returns the AOVs collected by the camera samples of the film
+func (f *Film) AOVs() *AOVs {
+	aovs := &AOVs{
+		Depth:    make([][]geometry.Float, f.Rows),
+		Normal:   make([][]geometry.Vec3, f.Rows),
+		Albedo:   make([][]geometry.Vec3, f.Rows),
+		Emission: make([][]geometry.Vec3, f.Rows),
+		Object:   make([][]int, f.Rows),
+		Material: make([][]int, f.Rows),
+	}
+	for y := 0; y < f.Rows; y++ {
+		aovs.Depth[y] = make([]geometry.Float, f.Cols)
+		aovs.Normal[y] = make([]geometry.Vec3, f.Cols)
+		aovs.Albedo[y] = make([]geometry.Vec3, f.Cols)
+		aovs.Emission[y] = make([]geometry.Vec3, f.Cols)
+		aovs.Object[y] = make([]int, f.Cols)
+		aovs.Material[y] = make([]int, f.Cols)
+	}
+	f.each(func(x, y int, pixel *filmPixel, scale geometry.Float) {
+		aov := pixel.aov
+		if aov == nil || aov.hits <= 0 {
+			aovs.Depth[y][x] = geometry.Float(math.Inf(+1))
+			return
+		}
+		aovs.Depth[y][x] = aov.depth / aov.hits
+		if !aov.normal.IsZero() {
+			aovs.Normal[y][x] = aov.normal.Normalize()
+		}
+		aovs.Albedo[y][x] = aov.albedo.Mult(scale)
+		aovs.Emission[y][x] = aov.emission.Mult(scale)
+		aovs.Object[y][x], aovs.Material[y][x] = aov.object, aov.material
+	})
+	return aovs
+}
+
+// Sees nothing but the surfaces, for the AOVs of integrators that take no
+// camera samples themselves
+type surfacesOnly struct{}
+
+func (surfacesOnly) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	return geometry.Vec3{}
+}
+
+// Returns the farthest depth of a surface, which maps to white in the
+// depth image
+func (a *AOVs) MaxDepth() geometry.Float {
+	var far geometry.Float
+	for _, row := range a.Depth {
+		for _, depth := range row {
+			if !math.IsInf(float64(depth), 0) && depth > far {
+				far = depth
+			}
+		}
+	}
+	return far
+}
+
+// Returns the collected AOVs as images by name. Depth is a 16 bit gray
+// scale image scaled to MaxDepth, with nothing hit white. Normals are
+// mapped from [-1, 1] to [0, 1], albedos are linear, emission is encoded
+// for display and the passes and light groups are tone mapped like the
+// image. Object and material hold the raw numbers, 16 and 8 bit. Light
+// groups are named light_ and the name of the group. The samples image is
+// scaled so the most sampled pixel is white, the variance is only written
+// to OpenEXR.
+func (a *AOVs) Images() map[string]image.Image {
+	images := make(map[string]image.Image)
+	if a.Passes != nil {
+		for pass, name := range PassNames {
+			images[name] = colourImage(len(a.Passes), len(a.Passes[0]), func(x, y int) geometry.Vec3 {
+				return a.Passes[y][x][pass]
+			})
+		}
+	}
+	if a.Lights != nil {
+		for group, name := range a.LightGroups {
+			images["light_"+name] = colourImage(len(a.Lights), len(a.Lights[0]), func(x, y int) geometry.Vec3 {
+				if lights := a.Lights[y][x]; lights != nil {
+					return lights[group]
+				}
+				// Skipped pixels
+				return geometry.Vec3{}
+			})
+		}
+	}
+	if a.Samples != nil {
+		images["samples"] = samplesImage(a.Samples)
+	}
+	if a.Depth == nil {
+		return images
+	}
+
+	rows, cols := len(a.Depth), len(a.Depth[0])
+	bounds := image.Rect(0, 0, cols, rows)
+	depth := image.NewGray16(bounds)
+	normal := image.NewNRGBA(bounds)
+	albedo := image.NewNRGBA(bounds)
+	emission := newDisplayImage(cols, rows)
+	object := image.NewGray16(bounds)
+	material := image.NewGray(bounds)
+
+	far := a.MaxDepth()
+	toNRGBA := func(v geometry.Vec3) color.NRGBA {
+		v = v.Mult(255).Add(geometry.Vec3{0.5, 0.5, 0.5}).CLAMP()
+		return color.NRGBA{uint8(v.X), uint8(v.Y), uint8(v.Z), 255}
+	}
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			d := uint16(0xffff)
+			if far > 0 && !math.IsInf(float64(a.Depth[y][x]), 0) {
+				d = uint16(math.Min(1, float64(a.Depth[y][x]/far))*0xffff + 0.5)
+			}
+			depth.SetGray16(x, y, color.Gray16{d})
+
+			if n := a.Normal[y][x]; !n.IsZero() {
+				normal.SetNRGBA(x, y, toNRGBA(n.Add(geometry.Vec3{1, 1, 1}).Mult(0.5)))
+			} else {
+				normal.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+			}
+			albedo.SetNRGBA(x, y, toNRGBA(a.Albedo[y][x]))
+
+			setDisplayColour(emission, x, y, a.Emission[y][x])
+
+			object.SetGray16(x, y, color.Gray16{uint16(a.Object[y][x])})
+			material.SetGray(x, y, color.Gray{uint8(a.Material[y][x])})
+		}
+	}
+
+	images["depth"] = depth
+	images["normal"] = normal
+	images["albedo"] = albedo
+	images["emission"] = emission
+	images["object"] = object
+	images["material"] = material
+	return images
+}
+
+func samplesImage(samples [][]int) image.Image {
+	most := 1
+	for _, row := range samples {
+		for _, count := range row {
+			if count > most {
+				most = count
+			}
+		}
+	}
+	img := image.NewGray16(image.Rect(0, 0, len(samples[0]), len(samples)))
+	for y, row := range samples {
+		for x, count := range row {
+			img.SetGray16(x, y, color.Gray16{uint16(count * 0xffff / most)})
+		}
+	}
+	return img
+}
+
+// Returns an image of the colours returned by at, tone mapped and encoded
+// like the image
+func colourImage(rows, cols int, at func(x, y int) geometry.Vec3) image.Image {
+	img := newDisplayImage(cols, rows)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			setDisplayColour(img, x, y, ToneMap(at(x, y)))
+		}
+	}
+	return img
+}
+
+// Adds the collected AOVs to img as layers named like the images of
+// Images. Depth holds the distance as it is, infinite where nothing is
+// hit, and the colours are linear.
+func (a *AOVs) AddChannels(img *hdr.Image) {
+	if a.Passes != nil {
+		for pass, name := range PassNames {
+			addColourChannels(img, name, func(x, y int) geometry.Vec3 { return a.Passes[y][x][pass] })
+		}
+	}
+	for group, name := range a.LightGroups {
+		addColourChannels(img, "light_"+name, func(x, y int) geometry.Vec3 {
+			if lights := a.Lights[y][x]; lights != nil {
+				return lights[group]
+			}
+			return geometry.Vec3{}
+		})
+	}
+	if a.Samples != nil {
+		samples, variance := img.Channel("samples.Y"), img.Channel("variance.Y")
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				i := y*img.Width + x
+				samples[i], variance[i] = float32(a.Samples[y][x]), float32(a.Variance[y][x])
+			}
+		}
+	}
+	if a.Depth == nil {
+		return
+	}
+
+	addColourChannels(img, "albedo", func(x, y int) geometry.Vec3 { return a.Albedo[y][x] })
+	addColourChannels(img, "emission", func(x, y int) geometry.Vec3 { return a.Emission[y][x] })
+	depth, object, material := img.Channel("depth.Z"), img.Channel("object.ID"), img.Channel("material.ID")
+	normalX, normalY, normalZ := img.Channel("normal.X"), img.Channel("normal.Y"), img.Channel("normal.Z")
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			i := y*img.Width + x
+			depth[i] = float32(a.Depth[y][x])
+			object[i], material[i] = float32(a.Object[y][x]), float32(a.Material[y][x])
+			normal := a.Normal[y][x]
+			normalX[i], normalY[i], normalZ[i] = float32(normal.X), float32(normal.Y), float32(normal.Z)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"math/rand"
+)
+
+/////////////////////////////////
+// Bidirectional path tracing
+/////////////////////////////////
+
+// BDPT traces a path from the camera and one from an emitter for every
+// sample and connects every vertex of the one to every vertex of the
+// other (Veach, 1997). Each connection is a different way of sampling the
+// same light path, the power heuristic weights them against each other so
+// every path is found by the strategy that is best at it. Light that is
+// hard to reach from the camera, like small lights seen through glass,
+// converges much faster than with the path tracer.
+//
+// Light paths start on emitters like the photons of PhotonChunk, but at a
+// uniformly chosen point on the surface. The pinhole camera can't be hit
+// by light paths, so they are always connected to camera vertices behind
+// the first. The sun and sky are only found from the camera side, by
+// sampling the sun at every vertex and by rays leaving the scene.
+type BDPT struct {
+	Scene  *geometry.Scene
+	Lights *LightSampler
+
+	areaLights, sun *LightSampler
+}
+
+func NewBDPT(scene *geometry.Scene, lights *LightSampler) *BDPT {
+	return &BDPT{
+		Scene:      scene,
+		Lights:     lights,
+		areaLights: lights.Filter(func(light *Light) bool { return light.Shape != nil }),
+		sun:        lights.Filter(func(light *Light) bool { return light.Shape == nil }),
+	}
+}
+
+const (
+	vertexCamera = iota
+	vertexLight
+	vertexSurface
+)
+
+// A vertex of a camera or light path. The densities are per unit area at
+// the vertex, pdfFwd for sampling it in the direction the path was built
+// and pdfRev for sampling it from the other end.
+type bdptVertex struct {
+	kind             int
+	position, normal geometry.Vec3
+	shape            *geometry.Shape
+	throughput       geometry.Vec3
+	pdfFwd, pdfRev   float64
+	delta            bool
+}
+
+// Converts a density per solid angle of sampling next from v to a density
+// per unit area at next.
+func (v *bdptVertex) convert(pdf float64, next *bdptVertex) float64 {
+	direction := next.position.Sub(v.position)
+	distance2 := float64(direction.Dot(direction))
+	if distance2 == 0 {
+		return 0
+	}
+	if next.kind != vertexCamera {
+		pdf *= math.Abs(float64(next.normal.Dot(direction))) / math.Sqrt(distance2)
+	}
+	return pdf / distance2
+}
+
+// The scattering at v of light arriving from next towards prev. Only
+// diffuse surfaces scatter light into a given direction; for emitters this
+// is whether next is in front of them.
+func (v *bdptVertex) f(prev, next *bdptVertex) geometry.Vec3 {
+	toNext := next.position.Sub(v.position)
+	switch {
+	case v.kind == vertexLight:
+		if v.normal.Dot(toNext) > 0 {
+			return geometry.Vec3{1, 1, 1}
+		}
+	case v.kind == vertexSurface && !v.delta:
+		toPrev := prev.position.Sub(v.position)
+		if v.normal.Dot(toPrev)*v.normal.Dot(toNext) > 0 {
+			return v.shape.Colour.Mult(1 / math.Pi)
+		}
+	}
+	return geometry.Vec3{0, 0, 0}
+}
+
+// The density per unit area at next of continuing a path that arrived at v
+// from prev towards next. Emitters have no prev and send light cosine
+// weighted into the hemisphere in front of them.
+func (v *bdptVertex) pdf(prev, next *bdptVertex) float64 {
+	toNext := next.position.Sub(v.position).Normalize()
+	cos := float64(v.normal.Dot(toNext))
+	switch {
+	case v.kind == vertexLight:
+		if cos <= 0 {
+			return 0
+		}
+	case v.kind == vertexSurface && !v.delta:
+		if v.normal.Dot(prev.position.Sub(v.position)) < 0 {
+			cos = -cos
+		}
+		if cos <= 0 {
+			return 0
+		}
+	default:
+		return 0
+	}
+	return v.convert(cos/math.Pi, next)
+}
+
+// The density per unit area of a light path starting at v
+func (b *BDPT) pdfLightOrigin(v *bdptVertex) float64 {
+	return b.areaLights.Pdf(v.shape) / float64(v.shape.Area())
+}
+
+// The ray a path left the scene with. pdf is the density its direction was
+// sampled with, zero for camera rays and after specular bounces.
+type bdptEscape struct {
+	ray        geometry.Ray
+	throughput geometry.Vec3
+	pdf        float64
+}
+
+// Continues path along ray until it leaves the scene or holds maxVertices
+// vertices. pdf is the density per solid angle of the direction of ray.
+// Returns the extended path and how it left the scene if it did.
+func (b *BDPT) walk(path []bdptVertex, ray geometry.Ray, throughput geometry.Vec3, pdf float64, maxVertices int, rand *rand.Rand) ([]bdptVertex, *bdptEscape) {
+	for len(path) < maxVertices {
+		shape, distance := ClosestIntersection(b.Scene.Objects, ray)
+		if shape == nil {
+			return path, &bdptEscape{ray, throughput, pdf}
+		}
+		impact := ray.Origin.Add(ray.Direction.Mult(distance))
+		normal := shape.NormalDir(impact).Normalize()
+
+		vertex := bdptVertex{kind: vertexSurface, position: impact, normal: normal, shape: shape, throughput: throughput}
+		vertex.pdfFwd = path[len(path)-1].convert(pdf, &vertex)
+		path = append(path, vertex)
+		if len(path) == maxVertices {
+			break
+		}
+
+		current, prev := &path[len(path)-1], &path[len(path)-2]
+		outgoing := normal
+		if normal.Dot(ray.Direction) > 0 {
+			outgoing = normal.Mult(-1)
+		}
+
+		if shape.Material != geometry.DIFFUSE {
+			// Mirrors and glass can't be connected to, their densities
+			// are left at zero
+			current.delta = true
+			ray = specularBounce(ray, shape, impact, normal, outgoing, rand)
+			pdf = 0
+			continue
+		}
+
+		// The cosine and pi of the lambertian reflectance cancel against
+		// the density of the bounce
+		direction, bouncePdf := SampleCosineHemisphere(outgoing, rand)
+		throughput = throughput.MultVec(shape.Colour)
+		reversePdf := math.Abs(float64(outgoing.Dot(ray.Direction))) / math.Pi
+		prev.pdfRev = current.convert(reversePdf, prev)
+		ray, pdf = geometry.Ray{impact, direction}, bouncePdf
+	}
+	return path, nil
+}
+
+// Builds the path from the camera along ray
+func (b *BDPT) cameraPath(ray geometry.Ray, rand *rand.Rand) ([]bdptVertex, *bdptEscape) {
+	path := make([]bdptVertex, 1, Config.MaxDepth+2)
+	path[0] = bdptVertex{kind: vertexCamera, position: ray.Origin, throughput: geometry.Vec3{1, 1, 1}}
+	// The camera can't be reached from light paths, the density of its
+	// rays is never compared against anything
+	return b.walk(path, ray, geometry.Vec3{1, 1, 1}, 0, Config.MaxDepth+2, rand)
+}
+
+// Builds a path from a point on an emitter chosen by its power
+func (b *BDPT) lightPath(rand *rand.Rand) []bdptVertex {
+	light, choice := b.areaLights.Sample(rand)
+	if light == nil {
+		return nil
+	}
+	shape := light.Shape
+	position, normal := shape.SampleSurface(rand.Float64(), rand.Float64(), rand.Float64())
+	pdfPosition := choice / float64(shape.Area())
+
+	path := make([]bdptVertex, 1, Config.MaxDepth+1)
+	path[0] = bdptVertex{
+		kind:       vertexLight,
+		position:   position,
+		normal:     normal,
+		shape:      shape,
+		throughput: shape.Emission.Mult(geometry.Float(1 / pdfPosition)),
+		pdfFwd:     pdfPosition,
+	}
+
+	// Cosine weighted emission, the cosine cancels against the density
+	direction, pdf := SampleCosineHemisphere(normal, rand)
+	throughput := path[0].throughput.Mult(math.Pi)
+	ray := geometry.Ray{position.Add(normal.Mult(1e-4)), direction}
+	path, _ = b.walk(path, ray, throughput, pdf, Config.MaxDepth+1, rand)
+	return path
+}
+
+// Tells whether nothing blocks the line between two vertices
+func (b *BDPT) visible(from, to *bdptVertex) bool {
+	direction := to.position.Sub(from.position)
+	distance := direction.Abs()
+	shape, hit := ClosestIntersection(b.Scene.Objects, geometry.Ray{from.position, direction.Mult(1 / distance)})
+	return shape == nil || hit >= distance*(1-1e-3)
+}
+
+// The geometric term between two vertices
+func geometryTerm(a, b *bdptVertex) float64 {
+	direction := b.position.Sub(a.position)
+	distance2 := float64(direction.Dot(direction))
+	cos := math.Abs(float64(a.normal.Dot(direction))) * math.Abs(float64(b.normal.Dot(direction)))
+	return cos / (distance2 * distance2)
+}
+
+// The weight of the path made of the first s light and t camera vertices
+// among all the ways to sample it, found by walking the densities of the
+// vertices in both directions (Veach, 1997, section 10.2).
+func (b *BDPT) misWeight(light, camera []bdptVertex, s, t int) float64 {
+	if s+t == 2 {
+		return 1
+	}
+	// Work on copies, the reverse densities at the connection change
+	light = append([]bdptVertex(nil), light[:s]...)
+	camera = append([]bdptVertex(nil), camera[:t]...)
+
+	pt, ptMinus := &camera[t-1], &camera[t-2]
+	if s > 0 {
+		qs := &light[s-1]
+		var qsMinus *bdptVertex
+		if s > 1 {
+			qsMinus = &light[s-2]
+		}
+		pt.pdfRev = qs.pdf(qsMinus, pt)
+		ptMinus.pdfRev = pt.pdf(qs, ptMinus)
+		qs.pdfRev = pt.pdf(ptMinus, qs)
+		if qsMinus != nil {
+			qsMinus.pdfRev = qs.pdf(pt, qsMinus)
+		}
+	} else {
+		// pt is on an emitter that could have started a light path
+		origin := bdptVertex{kind: vertexLight, position: pt.position, normal: pt.normal, shape: pt.shape}
+		pt.pdfRev = b.pdfLightOrigin(pt)
+		ptMinus.pdfRev = origin.pdf(nil, ptMinus)
+	}
+
+	// Deltas can't be compared, they count as one
+	remap := func(pdf float64) float64 {
+		if pdf == 0 {
+			return 1
+		}
+		return pdf * pdf
+	}
+
+	sum := 0.0
+	ratio := 1.0
+	// Moving the connection towards the camera. Connecting to the camera
+	// itself isn't a strategy.
+	for i := t - 1; i > 1; i-- {
+		ratio *= remap(camera[i].pdfRev) / remap(camera[i].pdfFwd)
+		if !camera[i].delta && !camera[i-1].delta {
+			sum += ratio
+		}
+	}
+	ratio = 1.0
+	// Moving the connection towards the light
+	for i := s - 1; i >= 0; i-- {
+		ratio *= remap(light[i].pdfRev) / remap(light[i].pdfFwd)
+		if !light[i].delta && (i == 0 || !light[i-1].delta) {
+			sum += ratio
+		}
+	}
+	return 1 / (1 + sum)
+}
+
+// The contribution of connecting the first s vertices of the light path
+// to the first t of the camera path, weighted against the other strategies
+func (b *BDPT) connect(light, camera []bdptVertex, s, t int) geometry.Vec3 {
+	pt := &camera[t-1]
+	if pt.delta {
+		return geometry.Vec3{0, 0, 0}
+	}
+
+	var contribution geometry.Vec3
+	if s == 0 {
+		// The camera path found an emitter by itself
+		ptMinus := &camera[t-2]
+		if pt.shape.Emission.IsZero() || pt.normal.Dot(ptMinus.position.Sub(pt.position)) <= 0 {
+			return geometry.Vec3{0, 0, 0}
+		}
+		contribution = pt.throughput.MultVec(pt.shape.Emission)
+		if b.pdfLightOrigin(pt) == 0 {
+			// No light path starts on unbounded emitters
+			return contribution
+		}
+	} else {
+		qs := &light[s-1]
+		if qs.delta {
+			return geometry.Vec3{0, 0, 0}
+		}
+		var qsMinus *bdptVertex
+		if s > 1 {
+			qsMinus = &light[s-2]
+		}
+		contribution = qs.throughput.MultVec(qs.f(qsMinus, pt)).MultVec(pt.f(&camera[t-2], qs)).MultVec(pt.throughput)
+		if contribution.IsZero() || !b.visible(pt, qs) {
+			return geometry.Vec3{0, 0, 0}
+		}
+		contribution = contribution.Mult(geometry.Float(geometryTerm(pt, qs)))
+	}
+	return contribution.Mult(geometry.Float(b.misWeight(light, camera, s, t)))
+}
+
+func (b *BDPT) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	camera, escaped := b.cameraPath(ray, rand)
+	light := b.lightPath(rand)
+
+	var radiance geometry.Vec3
+	for t := 2; t <= len(camera); t++ {
+		for s := 0; s <= len(light) && s+t-2 <= Config.MaxDepth; s++ {
+			radiance.AddInPlace(b.connect(light, camera, s, t))
+		}
+	}
+
+	if b.Scene.Sky == nil {
+		return radiance
+	}
+	// Paths lit by the sun and sky, sampled like the path tracer does
+	for t := 1; t < len(camera); t++ {
+		vertex := &camera[t]
+		if vertex.delta {
+			continue
+		}
+		outgoing := vertex.normal
+		if outgoing.Dot(camera[t-1].position.Sub(vertex.position)) < 0 {
+			outgoing = outgoing.Mult(-1)
+		}
+		sun := EmitterSampling(vertex.position, outgoing, vertex.shape, b.Scene, b.sun, rand)
+		radiance.AddInPlace(vertex.throughput.MultVec(vertex.shape.Colour).MultVec(sun))
+	}
+	if escaped != nil {
+		radiance.AddInPlace(escaped.throughput.MultVec(missRadiance(escaped.ray, b.Scene, b.sun, escaped.pdf)))
+	}
+	return radiance
+}
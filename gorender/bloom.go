@@ -0,0 +1,211 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"runtime"
+	"sync"
+)
+
+////////////////////
+// Bloom
+////////////////////
+
+// A flat image of linear colours
+type glowLevel struct {
+	width, height int
+	pixels        []geometry.Vec3
+}
+
+func newGlowLevel(width, height int) *glowLevel {
+	return &glowLevel{width, height, make([]geometry.Vec3, width*height)}
+}
+
+// Returns pixel x, y, or the closest pixel on the edge if it lies outside
+func (l *glowLevel) at(x, y int) geometry.Vec3 {
+	if x < 0 {
+		x = 0
+	} else if x >= l.width {
+		x = l.width - 1
+	}
+	if y < 0 {
+		y = 0
+	} else if y >= l.height {
+		y = l.height - 1
+	}
+	return l.pixels[y*l.width+x]
+}
+
+// Bloom spreads the light of pixels brighter than threshold over their
+// surroundings, like the glare of bright lights in a lens, changing
+// colours in place. The light above the threshold is blurred at every
+// level of an image pyramid, each half the size of the one before, and the
+// levels are averaged. Every level keeps the energy of the light, but for
+// a little at the edges of levels of odd size, so the glow that is added
+// is as bright as the light taken away: intensity is the part of it that
+// is spread out. levels sets the size of the glow, which doubles with
+// every level.
+func Bloom(colours [][]geometry.Vec3, levels int, threshold, intensity float64) {
+	rows, cols := len(colours), len(colours[0])
+	bright := func(x, y int) geometry.Vec3 {
+		if x >= cols {
+			x = cols - 1
+		}
+		if y >= rows {
+			y = rows - 1
+		}
+		colour := colours[y][x]
+		if l := luminance(colour); l > threshold {
+			return colour.Mult(geometry.Float((l - threshold) / l))
+		}
+		return geometry.Vec3{}
+	}
+
+	// The pyramid starts at half the size of the image, which is the only
+	// level that is blurred at full size
+	half := newGlowLevel((cols+1)/2, (rows+1)/2)
+	parallel(half.height, func(y int) {
+		for x := 0; x < half.width; x++ {
+			sum := bright(2*x, 2*y).Add(bright(2*x+1, 2*y)).
+				Add(bright(2*x, 2*y+1)).Add(bright(2*x+1, 2*y+1))
+			half.pixels[y*half.width+x] = sum.Mult(0.25)
+		}
+	})
+	pyramid := []*glowLevel{blur(half)}
+	for len(pyramid) < levels {
+		last := pyramid[len(pyramid)-1]
+		if last.width < 2 && last.height < 2 {
+			break
+		}
+		pyramid = append(pyramid, blur(downsample(last)))
+	}
+
+	// Sum up the levels from the smallest one
+	glow := pyramid[len(pyramid)-1]
+	for i := len(pyramid) - 2; i >= 0; i-- {
+		upsampled := upsample(glow, pyramid[i].width, pyramid[i].height)
+		for j := range upsampled.pixels {
+			upsampled.pixels[j].AddInPlace(pyramid[i].pixels[j])
+		}
+		glow = upsampled
+	}
+
+	scale := geometry.Float(intensity / float64(len(pyramid)))
+	columns, lines := newBilinearTable(glow.width, cols), newBilinearTable(glow.height, rows)
+	parallel(rows, func(y int) {
+		for x := range colours[y] {
+			spread := glow.bilinear(columns, lines, x, y).Mult(scale)
+			colours[y][x] = colours[y][x].Add(spread).Sub(bright(x, y).Mult(geometry.Float(intensity)))
+		}
+	})
+}
+
+// Runs f for every number from 0 to n-1, split between as many goroutines
+// as there are cores
+func parallel(n int, f func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			for i := worker; i < n; i += workers {
+				f(i)
+			}
+			wg.Done()
+		}(worker)
+	}
+	wg.Wait()
+}
+
+// The weights of a 5 tap binomial filter, close to a gaussian
+var glowKernel = [5]geometry.Float{1.0 / 16, 4.0 / 16, 6.0 / 16, 4.0 / 16, 1.0 / 16}
+
+// Blurs level with the glow kernel horizontally and then vertically
+func blur(level *glowLevel) *glowLevel {
+	horizontal := newGlowLevel(level.width, level.height)
+	parallel(level.height, func(y int) {
+		for x := 0; x < level.width; x++ {
+			var sum geometry.Vec3
+			for i, weight := range glowKernel {
+				sum.AddInPlace(level.at(x+i-2, y).Mult(weight))
+			}
+			horizontal.pixels[y*level.width+x] = sum
+		}
+	})
+	vertical := newGlowLevel(level.width, level.height)
+	parallel(level.height, func(y int) {
+		for x := 0; x < level.width; x++ {
+			var sum geometry.Vec3
+			for i, weight := range glowKernel {
+				sum.AddInPlace(horizontal.at(x, y+i-2).Mult(weight))
+			}
+			vertical.pixels[y*level.width+x] = sum
+		}
+	})
+	return vertical
+}
+
+// Halves the size of level, averaging every 2x2 block of pixels
+func downsample(level *glowLevel) *glowLevel {
+	small := newGlowLevel((level.width+1)/2, (level.height+1)/2)
+	parallel(small.height, func(y int) {
+		for x := 0; x < small.width; x++ {
+			sum := level.at(2*x, 2*y).Add(level.at(2*x+1, 2*y)).
+				Add(level.at(2*x, 2*y+1)).Add(level.at(2*x+1, 2*y+1))
+			small.pixels[y*small.width+x] = sum.Mult(0.25)
+		}
+	})
+	return small
+}
+
+// Scales level up to the given size with bilinear interpolation
+func upsample(level *glowLevel, width, height int) *glowLevel {
+	large := newGlowLevel(width, height)
+	columns, lines := newBilinearTable(level.width, width), newBilinearTable(level.height, height)
+	parallel(height, func(y int) {
+		for x := 0; x < width; x++ {
+			large.pixels[y*width+x] = level.bilinear(columns, lines, x, y)
+		}
+	})
+	return large
+}
+
+// The two neighbouring pixels of a smaller image that every pixel of a
+// larger one lies between, and how far it is from the first one
+type bilinearTable struct {
+	first, second []int
+	fraction      []geometry.Float
+}
+
+// Returns the table for scaling from pixels to size pixels
+func newBilinearTable(pixels, size int) bilinearTable {
+	table := bilinearTable{make([]int, size), make([]int, size), make([]geometry.Float, size)}
+	for i := range table.first {
+		position := (float64(i)+0.5)*float64(pixels)/float64(size) - 0.5
+		first := math.Floor(position)
+		table.first[i] = clampIndex(int(first), pixels)
+		table.second[i] = clampIndex(int(first)+1, pixels)
+		table.fraction[i] = geometry.Float(position - first)
+	}
+	return table
+}
+
+func clampIndex(i, size int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= size {
+		return size - 1
+	}
+	return i
+}
+
+// Interpolates pixel x, y of the level scaled up with the tables for its
+// columns and lines
+func (l *glowLevel) bilinear(columns, lines bilinearTable, x, y int) geometry.Vec3 {
+	top, bottom := l.pixels[lines.first[y]*l.width:], l.pixels[lines.second[y]*l.width:]
+	x0, x1, fx, fy := columns.first[x], columns.second[x], columns.fraction[x], lines.fraction[y]
+	upper := top[x0].Mult(1 - fx).Add(top[x1].Mult(fx))
+	lower := bottom[x0].Mult(1 - fx).Add(bottom[x1].Mult(fx))
+	return upper.Mult(1 - fy).Add(lower.Mult(fy))
+}
@@ -0,0 +1,235 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"sync"
+)
+
+////////////////////
+// Denoising
+////////////////////
+
+// Features describe the surface seen through a pixel. They are averaged
+// over the samples of the pixel and guide the denoiser, which must not
+// blur across the edges between surfaces.
+type Features struct {
+	Albedo, Normal geometry.Vec3
+	Depth          geometry.Float
+}
+
+func (f *Features) add(other Features) {
+	f.Albedo.AddInPlace(other.Albedo)
+	f.Normal.AddInPlace(other.Normal)
+	f.Depth += other.Depth
+}
+
+func (f Features) scale(factor geometry.Float) Features {
+	return Features{f.Albedo.Mult(factor), f.Normal.Mult(factor), f.Depth * factor}
+}
+
+// Returns the features of the first diffuse surface along ray. Mirrors
+// and glass are followed, reflecting off mirrors and passing through
+// glass, so that what is seen in them stays sharp as well. The first
+// surface hit, mirror or not, is recorded in aov if it isn't nil.
+func surfaceFeatures(scene *geometry.Scene, ray geometry.Ray, aov *aovPixel) Features {
+	if aov != nil {
+		// Nothing hit unless found below
+		*aov = aovPixel{strongest: 1}
+	}
+	var depth geometry.Float
+	for bounce := 0; bounce < maxSpecularDepth; bounce++ {
+		shape, distance := ClosestIntersection(scene.Objects, ray)
+		if shape == nil {
+			break
+		}
+		depth += distance
+		impact := ray.Origin.Add(ray.Direction.Mult(distance))
+		normal := shape.NormalDir(impact).Normalize()
+		if aov != nil && bounce == 0 {
+			aov.record(scene, shape, distance, normal)
+		}
+		outgoing := normal
+		if normal.Dot(ray.Direction) > 0 {
+			outgoing = normal.Mult(-1)
+		}
+		if shape.Material == geometry.DIFFUSE {
+			return Features{shape.Colour, outgoing, depth}
+		}
+
+		direction, ok := refract(ray.Direction, normal, outgoing)
+		if shape.Material != geometry.REFRACTIVE || !ok {
+			direction = ray.Direction.Sub(outgoing.Mult(2 * outgoing.Dot(ray.Direction))).Normalize()
+		}
+		ray = geometry.Ray{impact, direction}
+	}
+	// Rays leaving the scene have no features, they only blend with each
+	// other
+	return Features{}
+}
+
+const (
+	denoiseSigmaLuminance = 4    // Standard deviations between similar colours
+	denoiseSigmaNormal    = 128  // Exponent on the cosine between normals
+	denoiseSigmaDepth     = 0.05 // Relative depth difference that is an edge
+	denoiseSigmaAlbedo    = 0.1  // Albedo difference that is an edge
+)
+
+// The weights of the 5x5 B3 spline that is spread out by every pass
+var atrousKernel = [5]float64{1.0 / 16, 1.0 / 4, 3.0 / 8, 1.0 / 4, 1.0 / 16}
+
+// Removes noise from colours with an edge-avoiding à-trous wavelet filter
+// (Dammertz et al., 2010). Every pass blurs with a 5x5 kernel whose taps
+// are twice as far apart as in the pass before, weighted by how similar
+// the neighbouring pixels' features are. As in SVGF (Schied et al., 2017)
+// the colour weight is scaled by the standard error of each pixel, which
+// variance holds squared, so converged pixels keep their detail. The
+// albedo is divided out before filtering so textures aren't blurred.
+func Denoise(colours [][]geometry.Vec3, features [][]Features, variance [][]float64, passes int) [][]geometry.Vec3 {
+	rows, cols := len(colours), len(colours[0])
+
+	irradiance := make([][]geometry.Vec3, rows)
+	irradianceVariance := make([][]float64, rows)
+	for y := range irradiance {
+		irradiance[y] = make([]geometry.Vec3, cols)
+		irradianceVariance[y] = make([]float64, cols)
+		for x := range irradiance[y] {
+			albedo := features[y][x].Albedo
+			irradiance[y][x] = demodulate(colours[y][x], albedo)
+			scale := math.Max(luminance(albedo), minAlbedo)
+			irradianceVariance[y][x] = variance[y][x] / (scale * scale)
+		}
+	}
+	variance = irradianceVariance
+
+	for pass := 0; pass < passes; pass++ {
+		irradiance, variance = atrousPass(irradiance, features, variance, 1<<uint(pass))
+	}
+
+	result := make([][]geometry.Vec3, rows)
+	for y := range result {
+		result[y] = make([]geometry.Vec3, cols)
+		for x := range result[y] {
+			result[y][x] = remodulate(irradiance[y][x], features[y][x].Albedo)
+		}
+	}
+	return result
+}
+
+// Blurs variance with a 3x3 gaussian kernel
+func blurVariance(variance [][]float64) [][]float64 {
+	rows, cols := len(variance), len(variance[0])
+	kernel := [3]float64{0.25, 0.5, 0.25}
+	blurred := make([][]float64, rows)
+	for y := range blurred {
+		blurred[y] = make([]float64, cols)
+		for x := range blurred[y] {
+			var sum, weights float64
+			for j := -1; j <= 1; j++ {
+				for i := -1; i <= 1; i++ {
+					if qy, qx := y+j, x+i; qy >= 0 && qy < rows && qx >= 0 && qx < cols {
+						weight := kernel[i+1] * kernel[j+1]
+						sum += weight * variance[qy][qx]
+						weights += weight
+					}
+				}
+			}
+			blurred[y][x] = sum / weights
+		}
+	}
+	return blurred
+}
+
+// Dark albedos would amplify noise when divided out, they are left alone
+const minAlbedo = 0.01
+
+func demodulate(colour, albedo geometry.Vec3) geometry.Vec3 {
+	return geometry.Vec3{
+		colour.X / geometry.Float(math.Max(float64(albedo.X), minAlbedo)),
+		colour.Y / geometry.Float(math.Max(float64(albedo.Y), minAlbedo)),
+		colour.Z / geometry.Float(math.Max(float64(albedo.Z), minAlbedo)),
+	}
+}
+
+func remodulate(irradiance, albedo geometry.Vec3) geometry.Vec3 {
+	return geometry.Vec3{
+		irradiance.X * geometry.Float(math.Max(float64(albedo.X), minAlbedo)),
+		irradiance.Y * geometry.Float(math.Max(float64(albedo.Y), minAlbedo)),
+		irradiance.Z * geometry.Float(math.Max(float64(albedo.Z), minAlbedo)),
+	}
+}
+
+// Runs one filter pass with the taps step pixels apart, every row on its
+// own goroutine. Returns the filtered colours and their variance.
+func atrousPass(colours [][]geometry.Vec3, features [][]Features, variance [][]float64, step int) ([][]geometry.Vec3, [][]float64) {
+	rows, cols := len(colours), len(colours[0])
+	filtered := make([][]geometry.Vec3, rows)
+	filteredVariance := make([][]float64, rows)
+
+	// Estimates from few samples are unreliable, the colour weights use
+	// the variance of the neighbourhood
+	blurred := blurVariance(variance)
+
+	var wg sync.WaitGroup
+	for y := 0; y < rows; y++ {
+		filtered[y] = make([]geometry.Vec3, cols)
+		filteredVariance[y] = make([]float64, cols)
+		wg.Add(1)
+		go func(y int) {
+			for x := 0; x < cols; x++ {
+				filtered[y][x], filteredVariance[y][x] = atrousPixel(colours, features, variance, blurred[y][x], x, y, step)
+			}
+			wg.Done()
+		}(y)
+	}
+	wg.Wait()
+	return filtered, filteredVariance
+}
+
+// Filters pixel x, y, whose colour weights are scaled by the standard
+// deviation in its neighbourhood.
+func atrousPixel(colours [][]geometry.Vec3, features [][]Features, variance [][]float64, localVariance float64, x, y, step int) (geometry.Vec3, float64) {
+	rows, cols := len(colours), len(colours[0])
+	centre := features[y][x]
+	luminanceCentre := luminance(colours[y][x])
+	sigmaLuminance := denoiseSigmaLuminance*math.Sqrt(localVariance) + 1e-4
+
+	var sum geometry.Vec3
+	var weights, sumVariance float64
+	for j := -2; j <= 2; j++ {
+		qy := y + j*step
+		if qy < 0 || qy >= rows {
+			continue
+		}
+		for i := -2; i <= 2; i++ {
+			qx := x + i*step
+			if qx < 0 || qx >= cols {
+				continue
+			}
+			other := features[qy][qx]
+
+			luminanceWeight := math.Abs(luminance(colours[qy][qx])-luminanceCentre) / sigmaLuminance
+			normalWeight := 1.0
+			if !centre.Normal.IsZero() || !other.Normal.IsZero() {
+				// Averaged normals are shorter than one at edges
+				cos := 0.0
+				if !centre.Normal.IsZero() && !other.Normal.IsZero() {
+					cos = math.Max(0, float64(centre.Normal.Normalize().Dot(other.Normal.Normalize())))
+				}
+				normalWeight = math.Pow(cos, denoiseSigmaNormal)
+			}
+			depthWeight := math.Abs(float64(centre.Depth-other.Depth)) /
+				(denoiseSigmaDepth*float64(centre.Depth)*float64(step) + 1e-4)
+			albedo := centre.Albedo.Sub(other.Albedo)
+			albedoWeight := float64(albedo.Dot(albedo)) / (denoiseSigmaAlbedo * denoiseSigmaAlbedo)
+
+			weight := atrousKernel[i+2] * atrousKernel[j+2] * normalWeight *
+				math.Exp(-luminanceWeight-depthWeight-albedoWeight)
+			sum.AddInPlace(colours[qy][qx].Mult(geometry.Float(weight)))
+			sumVariance += weight * weight * variance[qy][qx]
+			weights += weight
+		}
+	}
+	// The centre pixel always has a weight, the sum can't be zero
+	return sum.Mult(geometry.Float(1 / weights)), sumVariance / (weights * weights)
+}
@@ -0,0 +1,106 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+////////////////////////
+// Display encoding
+////////////////////////
+
+// Transfer functions encode linear values from 0 to 1 for display
+var TransferFunctions = map[string]func(float64) float64{
+	"srgb": func(x float64) float64 {
+		if x <= 0.0031308 {
+			return 12.92 * x
+		}
+		return 1.055*math.Pow(x, 1/2.4) - 0.055
+	},
+	"rec709": func(x float64) float64 {
+		if x < 0.018 {
+			return 4.5 * x
+		}
+		return 1.099*math.Pow(x, 0.45) - 0.099
+	},
+	// A pure power curve with Config.GammaFactor
+	"gamma": func(x float64) float64 {
+		return math.Pow(x, 1/Config.GammaFactor)
+	},
+}
+
+// Returns the names of all transfer functions in alphabetical order
+func TransferFunctionNames() []string {
+	var names []string
+	for name := range TransferFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Encodes a linear colour with Config.Transfer, clamping it to [0, 1]
+func EncodeColour(v geometry.Vec3) geometry.Vec3 {
+	v = v.CLAMPF()
+	transfer := TransferFunctions[Config.Transfer]
+	return geometry.Vec3{
+		geometry.Float(transfer(float64(v.X))),
+		geometry.Float(transfer(float64(v.Y))),
+		geometry.Float(transfer(float64(v.Z))),
+	}.CLAMPF()
+}
+
+// Returns an image to display colours in, 16 bits per channel if
+// Config.Bits is 16 and 8 otherwise
+func newDisplayImage(cols, rows int) draw.Image {
+	if Config.Bits == 16 {
+		return image.NewNRGBA64(image.Rect(0, 0, cols, rows))
+	}
+	return image.NewNRGBA(image.Rect(0, 0, cols, rows))
+}
+
+// Sets pixel x, y of an image made by newDisplayImage to colour, which is
+// tone mapped already. 8 bit images are dithered if Config.Dither is set.
+func setDisplayColour(img draw.Image, x, y int, colour geometry.Vec3) {
+	setEncodedColour(img, x, y, EncodeColour(colour))
+}
+
+// Sets pixel x, y of an image made by newDisplayImage to colour, which is
+// encoded for display already, clamping it to [0, 1]
+func setEncodedColour(img draw.Image, x, y int, colour geometry.Vec3) {
+	colour = colour.CLAMPF()
+	if img, ok := img.(*image.NRGBA64); ok {
+		img.SetNRGBA64(x, y, color.NRGBA64{
+			uint16(colour.X*0xffff + 0.5),
+			uint16(colour.Y*0xffff + 0.5),
+			uint16(colour.Z*0xffff + 0.5),
+			0xffff,
+		})
+		return
+	}
+	img.Set(x, y, color.NRGBA{
+		quantise(colour.X, x, y, 0),
+		quantise(colour.Y, x, y, 1),
+		quantise(colour.Z, x, y, 2),
+		255,
+	})
+}
+
+// Rounds v from [0, 1] to 8 bits. With Config.Dither, noise of up to one
+// step with a triangular distribution is added first, which breaks up the
+// bands of dark gradients without making the noise depend on the signal.
+// The noise is a hash of the pixel and channel, so renders stay
+// reproducible.
+func quantise(v geometry.Float, x, y, channel int) uint8 {
+	value := float64(v) * 255
+	if Config.Dither {
+		h := hash(hash(uint64(x), uint64(y)), uint64(channel))
+		u1, u2 := float64(h&0xffffffff)/(1<<32), float64(h>>32)/(1<<32)
+		value += u1 + u2 - 1
+	}
+	return uint8(math.Max(0, math.Min(255, math.Floor(value+0.5))))
+}
@@ -0,0 +1,321 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"image"
+	"math"
+	"sync"
+)
+
+////////////////////
+// Film
+////////////////////
+
+// The film adds up the samples of the whole image, each weighted by the
+// reconstruction filter for every pixel it reaches. Light tracing
+// integrators splat their light onto it instead, and progressive ones set
+// the final colour of their pixels. For the denoiser it keeps the features
+// of the surfaces seen, and the number of samples taken in every pixel and
+// the variance of their mean. It also keeps the AOVs, the passes and the
+// light of every light group.
+type Film struct {
+	Cols, Rows int
+	Filter     Filter
+	grid       pixelGrid
+	splats     []geometry.Vec3
+	samples    []int
+	variance   []float64
+	lock       sync.Mutex
+}
+
+// A camera sample, or the sum of the samples of a pixel weighted by the
+// filter
+type filmPixel struct {
+	colour   geometry.Vec3
+	features *Features // Nil unless the image is denoised
+	aov      *aovPixel // Nil unless AOVs are collected
+	passes   *Passes   // Nil unless the light is split into passes
+	lights   []geometry.Vec3
+	weight   geometry.Float
+}
+
+func (p *filmPixel) add(sample *filmPixel, weight geometry.Float) {
+	p.colour.AddInPlace(sample.colour.Mult(weight))
+	if sample.features != nil {
+		if p.features == nil {
+			p.features = new(Features)
+		}
+		p.features.add(sample.features.scale(weight))
+	}
+	if sample.aov != nil {
+		if p.aov == nil {
+			p.aov = new(aovPixel)
+		}
+		p.aov.add(sample.aov, weight)
+	}
+	if sample.passes != nil {
+		if p.passes == nil {
+			p.passes = new(Passes)
+		}
+		p.passes.add(sample.passes.scale(weight))
+	}
+	if sample.lights != nil {
+		if p.lights == nil {
+			p.lights = make([]geometry.Vec3, len(sample.lights))
+		}
+		for i, light := range sample.lights {
+			p.lights[i].AddInPlace(light.Mult(weight))
+		}
+	}
+	p.weight += sample.weight * weight
+}
+
+func NewFilm(cols, rows int, filter Filter) *Film {
+	size := cols * rows
+	return &Film{
+		Cols:     cols,
+		Rows:     rows,
+		Filter:   filter,
+		grid:     pixelGrid{image.Rect(0, 0, cols, rows), make([]filmPixel, size)},
+		splats:   make([]geometry.Vec3, size),
+		samples:  make([]int, size),
+		variance: make([]float64, size),
+	}
+}
+
+// Adds the pixels of buffer to the film. The borders of neighbouring
+// tiles overlap, so merges take turns.
+func (f *Film) Merge(buffer *TileBuffer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	grid := &buffer.grid
+	for y := grid.bounds.Min.Y; y < grid.bounds.Max.Y; y++ {
+		for x := grid.bounds.Min.X; x < grid.bounds.Max.X; x++ {
+			f.grid.at(x, y).add(grid.at(x, y), 1)
+		}
+	}
+	tile := buffer.Tile
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			i := (y-tile.Min.Y)*tile.Dx() + x - tile.Min.X
+			f.samples[y*f.Cols+x] = buffer.samples[i]
+			f.variance[y*f.Cols+x] = buffer.variance[i]
+		}
+	}
+}
+
+// Splats light arriving at position x, y of the image, in pixels from the
+// top left corner, over the pixels around it. Unlike camera samples,
+// splats are not averaged: the light is shared between the pixels by the
+// weights of the filter.
+func (f *Film) Splat(x, y float64, colour geometry.Vec3) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var total float64
+	f.grid.eachWeight(f.Filter, x, y, false, func(_, _ int, weight float64) {
+		total += weight
+	})
+	if total == 0 {
+		return
+	}
+	f.grid.eachWeight(f.Filter, x, y, true, func(px, py int, weight float64) {
+		f.splats[py*f.Cols+px].AddInPlace(colour.Mult(geometry.Float(weight / total)))
+	})
+}
+
+// Sets the colour of pixel x, y, replacing its samples
+func (f *Film) Set(x, y int, colour geometry.Vec3) {
+	*f.grid.at(x, y) = filmPixel{colour: colour, weight: 1}
+}
+
+// Calls found for every pixel with the factor that normalises the weights
+// of its samples, which is zero if it has none
+func (f *Film) each(found func(x, y int, pixel *filmPixel, scale geometry.Float)) {
+	for y := 0; y < f.Rows; y++ {
+		for x := 0; x < f.Cols; x++ {
+			pixel := f.grid.at(x, y)
+			var scale geometry.Float
+			if pixel.weight != 0 {
+				scale = 1 / pixel.weight
+			}
+			found(x, y, pixel, scale)
+		}
+	}
+}
+
+// Returns the colour of every pixel, the weighted mean of its samples and
+// the light splatted onto it
+func (f *Film) Colours() [][]geometry.Vec3 {
+	colours := make([][]geometry.Vec3, f.Rows)
+	for y := range colours {
+		colours[y] = make([]geometry.Vec3, f.Cols)
+	}
+	f.each(func(x, y int, pixel *filmPixel, scale geometry.Float) {
+		colours[y][x] = pixel.colour.Mult(scale).Add(f.splats[y*f.Cols+x])
+	})
+	return colours
+}
+
+// Returns the weighted mean of the features of the samples of every pixel,
+// zero unless they were collected
+func (f *Film) Features() [][]Features {
+	features := make([][]Features, f.Rows)
+	for y := range features {
+		features[y] = make([]Features, f.Cols)
+	}
+	f.each(func(x, y int, pixel *filmPixel, scale geometry.Float) {
+		if pixel.features != nil {
+			features[y][x] = pixel.features.scale(scale)
+		}
+	})
+	return features
+}
+
+// Returns the weighted mean of the passes of the samples of every pixel
+func (f *Film) Passes() [][]Passes {
+	passes := make([][]Passes, f.Rows)
+	for y := range passes {
+		passes[y] = make([]Passes, f.Cols)
+	}
+	f.each(func(x, y int, pixel *filmPixel, scale geometry.Float) {
+		if pixel.passes != nil {
+			passes[y][x] = pixel.passes.scale(scale)
+		}
+	})
+	return passes
+}
+
+// Returns the weighted mean of the light of every light group of the
+// samples of every pixel, nil for pixels without samples
+func (f *Film) Lights() [][][]geometry.Vec3 {
+	lights := make([][][]geometry.Vec3, f.Rows)
+	for y := range lights {
+		lights[y] = make([][]geometry.Vec3, f.Cols)
+	}
+	f.each(func(x, y int, pixel *filmPixel, scale geometry.Float) {
+		if pixel.lights != nil {
+			lights[y][x] = make([]geometry.Vec3, len(pixel.lights))
+			for i, light := range pixel.lights {
+				lights[y][x][i] = light.Mult(scale)
+			}
+		}
+	})
+	return lights
+}
+
+// Returns the number of samples taken in every pixel
+func (f *Film) Samples() [][]int {
+	samples := make([][]int, f.Rows)
+	for y := range samples {
+		samples[y] = f.samples[y*f.Cols : (y+1)*f.Cols]
+	}
+	return samples
+}
+
+// Returns the variance of the mean luminance of the samples taken in
+// every pixel
+func (f *Film) Variance() [][]float64 {
+	variance := make([][]float64, f.Rows)
+	for y := range variance {
+		variance[y] = f.variance[y*f.Cols : (y+1)*f.Cols]
+	}
+	return variance
+}
+
+// The pixels of a rectangle of the image
+type pixelGrid struct {
+	bounds image.Rectangle
+	pixels []filmPixel
+}
+
+func (g *pixelGrid) at(x, y int) *filmPixel {
+	return &g.pixels[(y-g.bounds.Min.Y)*g.bounds.Dx()+x-g.bounds.Min.X]
+}
+
+// Calls found for every pixel whose centre lies within the radius of
+// filter from position x, y, with the weight it gives the position. Only
+// pixels of the grid are found if inside is set.
+func (g *pixelGrid) eachWeight(filter Filter, x, y float64, inside bool, found func(px, py int, weight float64)) {
+	// Pixel centres lie half a pixel from their corner
+	x, y = x-0.5, y-0.5
+	minX, maxX := int(math.Floor(x-filter.Radius)), int(math.Ceil(x+filter.Radius))
+	minY, maxY := int(math.Floor(y-filter.Radius)), int(math.Ceil(y+filter.Radius))
+	if inside {
+		minX, maxX = clampRange(minX, maxX, g.bounds.Min.X, g.bounds.Max.X)
+		minY, maxY = clampRange(minY, maxY, g.bounds.Min.Y, g.bounds.Max.Y)
+	}
+	for py := minY; py <= maxY; py++ {
+		weightY := filter.Weight(y - float64(py))
+		if weightY == 0 {
+			continue
+		}
+		for px := minX; px <= maxX; px++ {
+			if weight := filter.Weight(x-float64(px)) * weightY; weight != 0 {
+				found(px, py, weight)
+			}
+		}
+	}
+}
+
+// Limits the inclusive range from low to high to the pixels from min to
+// max, exclusive
+func clampRange(low, high, min, max int) (int, int) {
+	if low < min {
+		low = min
+	}
+	if high > max-1 {
+		high = max - 1
+	}
+	return low, high
+}
+
+// The samples of one tile, taken by a worker into a buffer of its own
+// before they are merged into the film. The buffer reaches past the tile
+// as far as the filter spreads its samples. Every worker reuses its
+// buffer for all of its tiles.
+type TileBuffer struct {
+	Tile     image.Rectangle
+	filter   Filter
+	grid     pixelGrid
+	samples  []int
+	variance []float64
+}
+
+// Starts the buffer over for tile of film
+func (b *TileBuffer) Reset(film *Film, tile image.Rectangle) {
+	reach := film.Filter.reach()
+	bounds := tile.Inset(-reach).Intersect(film.grid.bounds)
+	b.Tile, b.filter = tile, film.Filter
+	b.grid.bounds = bounds
+	if size := bounds.Dx() * bounds.Dy(); cap(b.grid.pixels) < size {
+		b.grid.pixels = make([]filmPixel, size)
+	} else {
+		b.grid.pixels = b.grid.pixels[:size]
+		for i := range b.grid.pixels {
+			b.grid.pixels[i] = filmPixel{}
+		}
+	}
+	if size := tile.Dx() * tile.Dy(); cap(b.samples) < size {
+		b.samples, b.variance = make([]int, size), make([]float64, size)
+	} else {
+		b.samples, b.variance = b.samples[:size], b.variance[:size]
+		for i := range b.samples {
+			b.samples[i], b.variance[i] = 0, 0
+		}
+	}
+}
+
+// Adds a camera sample taken at position x, y of the image to the pixels
+// around it
+func (b *TileBuffer) addSample(x, y float64, sample *filmPixel) {
+	b.grid.eachWeight(b.filter, x, y, true, func(px, py int, weight float64) {
+		b.grid.at(px, py).add(sample, geometry.Float(weight))
+	})
+}
+
+// Records the number of samples taken in pixel x, y and the variance of
+// the mean of their luminance
+func (b *TileBuffer) setStatistics(x, y, samples int, variance float64) {
+	i := (y-b.Tile.Min.Y)*b.Tile.Dx() + x - b.Tile.Min.X
+	b.samples[i], b.variance[i] = samples, variance
+}
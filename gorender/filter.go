@@ -0,0 +1,94 @@
+package gorender
+
+import (
+	"math"
+	"sort"
+)
+
+////////////////////////////
+// Reconstruction filters
+////////////////////////////
+
+// A Filter weights the samples around the centre of a pixel when the film
+// adds them up. Filters are separable: the weight of a sample is the
+// product of Weight of its horizontal and vertical offsets from the
+// centre in pixels, which is zero from Radius on.
+type Filter struct {
+	Radius float64
+	Weight func(offset float64) float64
+}
+
+// The filters selectable by name with Config.Filter, with their usual radii
+var Filters = map[string]Filter{
+	// Averages the samples within the pixel
+	"box": {0.5, func(x float64) float64 {
+		// Half open, so samples on the border count for one pixel
+		if x >= -0.5 && x < 0.5 {
+			return 1
+		}
+		return 0
+	}},
+	"tent": {1, func(x float64) float64 {
+		return math.Max(0, 1-math.Abs(x))
+	}},
+	// Shifted down to reach zero at the radius
+	"gaussian": {1.5, func(x float64) float64 {
+		const alpha, radius = 2, 1.5
+		return math.Max(0, math.Exp(-alpha*x*x)-math.Exp(-alpha*radius*radius))
+	}},
+	// Mitchell and Netravali's cubic with B = C = 1/3, which balances
+	// blurring and ringing
+	"mitchell": {2, func(x float64) float64 {
+		const b, c = 1.0 / 3, 1.0 / 3
+		x = math.Abs(x)
+		switch {
+		case x < 1:
+			return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+		case x < 2:
+			return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+		}
+		return 0
+	}},
+	// A sinc windowed by a wider sinc, sharp but with some ringing
+	"lanczos": {3, func(x float64) float64 {
+		const lobes = 3
+		if math.Abs(x) >= lobes {
+			return 0
+		}
+		return sinc(x) * sinc(x/lobes)
+	}},
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Returns the names of all filters in alphabetical order
+func FilterNames() []string {
+	var names []string
+	for name := range Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns Config.Filter, stretched to Config.FilterRadius if it is set
+func NewFilter() Filter {
+	filter := Filters[Config.Filter]
+	if Config.FilterRadius <= 0 || Config.FilterRadius == filter.Radius {
+		return filter
+	}
+	scale, weight := filter.Radius/Config.FilterRadius, filter.Weight
+	return Filter{Config.FilterRadius, func(x float64) float64 {
+		return weight(x * scale)
+	}}
+}
+
+// The number of pixels on every side of a pixel that its samples reach
+func (f Filter) reach() int {
+	return int(math.Ceil(f.Radius - 0.5))
+}
@@ -0,0 +1,105 @@
+package gorender
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFilterWeights(t *testing.T) {
+	tests := []struct {
+		filter string
+		x      float64
+		weight float64
+	}{
+		{"box", 0, 1},
+		{"box", 0.49, 1},
+		{"box", -0.5, 1},
+		{"box", 0.5, 0},
+		{"tent", 0, 1},
+		{"tent", 0.5, 0.5},
+		{"tent", -0.25, 0.75},
+		{"tent", 1, 0},
+		{"gaussian", 0, 1 - math.Exp(-4.5)},
+		{"gaussian", 1, math.Exp(-2) - math.Exp(-4.5)},
+		{"gaussian", 1.5, 0},
+		{"mitchell", 0, 8.0 / 9},
+		{"mitchell", 1, 1.0 / 18},
+		{"mitchell", -1, 1.0 / 18},
+		{"mitchell", 2, 0},
+		{"lanczos", 0, 1},
+		{"lanczos", 1, 0},
+		{"lanczos", 1.5, -4 / (3 * math.Pi * math.Pi)},
+		{"lanczos", 3, 0},
+	}
+	for _, test := range tests {
+		if weight := Filters[test.filter].Weight(test.x); math.Abs(weight-test.weight) > 1e-12 {
+			t.Errorf("%v(%v) = %v, want %v", test.filter, test.x, weight, test.weight)
+		}
+	}
+}
+
+// Every filter is symmetric and ends at its radius
+func TestFilterShapes(t *testing.T) {
+	for name, filter := range Filters {
+		for _, x := range []float64{0.1, 0.3, 0.7, 1.2, 1.9, 2.5} {
+			if x < filter.Radius && filter.Weight(x) != filter.Weight(-x) {
+				t.Errorf("%v is not symmetric at %v: %v and %v", name, x, filter.Weight(x), filter.Weight(-x))
+			}
+		}
+		// The box counts its border on the negative side
+		for _, x := range []float64{filter.Radius, filter.Radius + 0.5, -filter.Radius - 0.5, 10, -10} {
+			if filter.Weight(x) != 0 {
+				t.Errorf("%v weighs %v at %v, past its radius %v", name, filter.Weight(x), x, filter.Radius)
+			}
+		}
+	}
+}
+
+func TestFilterReach(t *testing.T) {
+	tests := []struct {
+		radius float64
+		reach  int
+	}{
+		{0.5, 0},
+		{1, 1},
+		{1.5, 1},
+		{2, 2},
+		{3, 3},
+	}
+	for _, test := range tests {
+		if reach := (Filter{Radius: test.radius}).reach(); reach != test.reach {
+			t.Errorf("A filter of radius %v reaches %v pixels, want %v", test.radius, reach, test.reach)
+		}
+	}
+}
+
+func TestNewFilter(t *testing.T) {
+	defer func(filter string, radius float64) {
+		Config.Filter, Config.FilterRadius = filter, radius
+	}(Config.Filter, Config.FilterRadius)
+
+	tests := []struct {
+		filter    string
+		radius    float64
+		x, weight float64
+	}{
+		{"tent", 0, 0.5, 0.5},
+		{"tent", 1, 0.5, 0.5},
+		// Stretched to twice its width
+		{"tent", 2, 1, 0.5},
+		{"tent", 2, 2, 0},
+		{"box", 1, 0.75, 1},
+	}
+	for _, test := range tests {
+		Config.Filter, Config.FilterRadius = test.filter, test.radius
+		filter := NewFilter()
+		radius := test.radius
+		if radius == 0 {
+			radius = Filters[test.filter].Radius
+		}
+		if filter.Radius != radius || filter.Weight(test.x) != test.weight {
+			t.Errorf("%v of radius %v: radius %v and weight %v at %v, want %v and %v",
+				test.filter, test.radius, filter.Radius, filter.Weight(test.x), test.x, radius, test.weight)
+		}
+	}
+}
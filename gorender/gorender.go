@@ -3,11 +3,12 @@ package gorender
 import (
 	"fmt"
 	"github.com/Nightgunner5/goray/geometry"
+	"github.com/Nightgunner5/goray/hdr"
 	"github.com/Nightgunner5/goray/kd"
 	"image"
-	"image/color"
 	"math"
 	"math/rand"
+	"strings"
 	"time"
 )
 
@@ -42,54 +43,139 @@ func ClosestIntersection(shapes []*geometry.Shape, ray geometry.Ray) (*geometry.
 	return closest, bestHit
 }
 
-type Result struct {
-	x, y   int
-	colour geometry.Vec3
-}
-
 const (
 	AIR   = 1.0
 	GLASS = 1.5
 )
 
-func MonteCarloPixel(results chan Result, scene *geometry.Scene, diffuseMap /*, causticsMap*/ *kd.KDNode, start, rows int, rand *rand.Rand) {
-	samples := Config.NumRays
-	var px, py, dy, dx geometry.Float
-	var direction, contribution geometry.Vec3
-
-	for y := start; y < start+rows; y++ {
-		py = scene.Height - scene.Height*2*geometry.Float(y)/geometry.Float(scene.Rows)
-		for x := 0; x < scene.Cols; x++ {
-			px = -scene.Width + scene.Width*2*geometry.Float(x)/geometry.Float(scene.Cols)
-			var colourSamples geometry.Vec3
-			if x >= Config.Skip.Left && x < scene.Cols-Config.Skip.Right &&
-				y >= Config.Skip.Top && y < scene.Rows-Config.Skip.Bottom {
-				for sample := 0; sample < samples; sample++ {
-					dy, dx = geometry.Float(rand.Float32())*scene.PixH, geometry.Float(rand.Float32())*scene.PixW
-					direction = geometry.Vec3{
-						px + dx - scene.Camera.Origin.X,
-						py + dy - scene.Camera.Origin.Y,
-						-scene.Camera.Origin.Z,
-					}.Normalize()
-
-					contribution = Radiance(geometry.Ray{scene.Camera.Origin, direction}, scene, diffuseMap /*causticsMap,*/, 0, 1.0, rand)
-					colourSamples.AddInPlace(contribution)
-				}
+// Returns a ray from the camera through a random point of pixel x, y
+func CameraRay(scene *geometry.Scene, x, y int, rand *rand.Rand) geometry.Ray {
+	dy, dx := rand.Float32(), rand.Float32()
+	return pixelRay(scene, x, y, geometry.Float(dx), geometry.Float(dy))
+}
+
+// Returns the ray from the camera through the point of pixel x, y at
+// fractions dx, dy of the pixel's size from its corner.
+func pixelRay(scene *geometry.Scene, x, y int, dx, dy geometry.Float) geometry.Ray {
+	py := scene.Height - scene.Height*2*geometry.Float(y)/geometry.Float(scene.Rows)
+	px := -scene.Width + scene.Width*2*geometry.Float(x)/geometry.Float(scene.Cols)
+	dy, dx = dy*scene.PixH, dx*scene.PixW
+	direction := geometry.Vec3{
+		px + dx - scene.Camera.Origin.X,
+		py + dy - scene.Camera.Origin.Y,
+		-scene.Camera.Origin.Z,
+	}.Normalize()
+	return geometry.Ray{scene.Camera.Origin, direction}
+}
+
+// Whether pixel x, y lies in the border excluded by Config.Skip
+func Skipped(scene *geometry.Scene, x, y int) bool {
+	return x < Config.Skip.Left || x >= scene.Cols-Config.Skip.Right ||
+		y < Config.Skip.Top || y >= scene.Rows-Config.Skip.Bottom
+}
+
+// Samples every pixel of the tile of buffer into it
+func MonteCarloPixel(buffer *TileBuffer, scene *geometry.Scene, integrator Integrator, sampler Sampler, groups *LightGroups) {
+	stream := rand.New(sampler)
+	tile := buffer.Tile
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			if Skipped(scene, x, y) {
+				buffer.setStatistics(x, y, 0, 0)
+				continue
 			}
-			results <- Result{x, y, colourSamples.Mult(1.0 / geometry.Float(samples))}
+			sampler.StartPixel(x, y)
+			samplePixel(buffer, scene, integrator, x, y, sampler, stream, groups)
 		}
 	}
 }
 
-func CorrectColour(x geometry.Float) geometry.Float {
-	return geometry.Float(math.Pow(float64(x), 1.0/Config.GammaFactor)*255 + 0.5)
-}
+// The 95% confidence interval of the mean is 1.96 standard errors wide to
+// either side
+const confidence = 1.96
+
+// Samples pixel x, y Config.NumRays times and adds the samples to buffer.
+// With adaptive sampling, more samples are taken as long as the confidence
+// interval of the luminance is wider than Config.AdaptiveThreshold
+// relative to the mean, up to Config.MaxRays. The variance is tracked with
+// Welford's method. stream draws from sampler. With Config.Passes or light
+// groups, integrators that can split their light into passes do so and
+// the colour is their sum.
+func samplePixel(buffer *TileBuffer, scene *geometry.Scene, integrator Integrator, x, y int, sampler Sampler, stream *rand.Rand, groups *LightGroups) {
+	sample := filmPixel{weight: 1}
+	passIntegrator, split := integrator.(PassIntegrator)
+	split = split && (Config.Passes || groups != nil)
+	if split {
+		sample.passes = new(Passes)
+	}
+	if split && groups != nil {
+		sample.lights = make([]geometry.Vec3, len(groups.Names))
+	}
+	// Only the denoiser needs the features of the surfaces
+	if Config.Denoise > 0 {
+		sample.features = new(Features)
+	}
+	if Config.AOVs {
+		sample.aov = new(aovPixel)
+	}
+	var mean, squares float64
+	samples, target := 0, Config.NumRays
+	// The variance needs at least two samples
+	if Config.MaxRays > Config.NumRays && target < 2 {
+		target = 2
+	}
+	for {
+		for ; samples < target; samples++ {
+			sampler.StartSample(samples)
+			// The ray leaves through the point dx, dy of the pixel, dy
+			// counting upwards
+			dy, dx := stream.Float32(), stream.Float32()
+			ray := pixelRay(scene, x, y, geometry.Float(dx), geometry.Float(dy))
+			if split {
+				for i := range sample.lights {
+					sample.lights[i] = geometry.Vec3{}
+				}
+				*sample.passes = passIntegrator.RadiancePasses(ray, stream, groups, sample.lights)
+				sample.colour = sample.passes.Sum()
+			} else {
+				sample.colour = integrator.Radiance(ray, stream)
+			}
+			if sample.features != nil || sample.aov != nil {
+				features := surfaceFeatures(scene, ray, sample.aov)
+				if sample.features != nil {
+					*sample.features = features
+				}
+			}
+			buffer.addSample(float64(x)+float64(dx), float64(y)+1-float64(dy), &sample)
+
+			value := luminance(sample.colour)
+			delta := value - mean
+			mean += delta / float64(samples+1)
+			squares += delta * (value - mean)
+		}
 
-func CorrectColours(v geometry.Vec3) geometry.Vec3 {
-	v.X = CorrectColour(v.X)
-	v.Y = CorrectColour(v.Y)
-	v.Z = CorrectColour(v.Z)
-	return v
+		if samples >= Config.MaxRays || samples < 2 {
+			break
+		}
+		// Dark pixels are held to an absolute error, they would never
+		// converge relative to their mean
+		stdErr := math.Sqrt(squares / float64(samples-1) / float64(samples))
+		if confidence*stdErr <= Config.AdaptiveThreshold*math.Max(mean, 0.01) {
+			break
+		}
+		target = samples + Config.NumRays
+		if target > Config.MaxRays {
+			target = Config.MaxRays
+		}
+	}
+
+	// A single sample says nothing about the variance, assume the noise
+	// is as strong as the signal
+	variance := mean * mean
+	if samples > 1 {
+		variance = squares / float64(samples-1) / float64(samples)
+	}
+	buffer.setStatistics(x, y, samples, variance)
 }
 
 func mix(a, b geometry.Vec3, factor geometry.Float) geometry.Vec3 {
@@ -99,116 +185,251 @@ func mix(a, b geometry.Vec3, factor geometry.Float) geometry.Vec3 {
 	return a
 }
 
-func BloomFilter(img [][]geometry.Vec3, depth int) [][]geometry.Vec3 {
-	data := make([][]geometry.Vec3, len(img))
-	for i, _ := range data {
-		data[i] = make([]geometry.Vec3, len(img[0]))
+var Config struct {
+	MinDepth     int
+	MaxDepth     int
+	NumRays      int
+	MaxRays      int
+	LightSamples int
+	Integrator   string
+	Sampler      string
+	AODistance   float64
+	Photons      int
+	PhotonGather int
+	GatherRadius float64
+
+	Caustics      int
+	CausticGather int
+	CausticRadius float64
+
+	AdaptiveThreshold float64
+
+	// Pixels are rendered in square tiles of TileSize pixels, in
+	// TileOrder, by Workers goroutines
+	Workers   int
+	TileSize  int
+	TileOrder string
+
+	// The reconstruction filter from Filters, and its radius in pixels if
+	// not the usual one
+	Filter       string
+	FilterRadius float64
+
+	GammaFactor    float64
+	Transfer       string
+	Bits           int
+	Dither         bool
+	ToneMapper     string
+	Exposure       float64
+	WhitePoint     float64
+	BloomFactor    int
+	BloomThreshold float64
+	BloomIntensity float64
+
+	// The post processes to run in order, made by NewPostProcessing:
+	// PostProcessing on the linear colours and DisplayProcessing on the
+	// display encoded ones. Followed by their settings.
+	PostProcessing      []PostProcess
+	DisplayProcessing   []PostProcess
+	Vignette            float64
+	ChromaticAberration float64
+	Sharpen             float64
+	Lift, Gamma, Gain   geometry.Vec3
+	Saturation          float64
+	LUT                 string
+
+	Denoise int
+	AOVs    bool
+	Passes  bool
+
+	// Write the light of every emitter, or of the named groups of objects
+	LightBuffers bool
+	LightGroups  map[string][]int
+
+	Skip struct {
+		Top, Left, Right, Bottom int
 	}
+}
 
-	const box_width = 2
-	factor := geometry.Float(1.0 / math.Pow(2*box_width+1, 2))
+// A rendered frame. Image is ready to be displayed, with tone mapping,
+// post processing and the transfer function applied, while Colours hold
+// the linear radiance of every pixel.
+type Frame struct {
+	Image   image.Image
+	Colours [][]geometry.Vec3
+	AOVs    *AOVs
+}
 
-	source := img
-	for iteration := 0; iteration < depth; iteration++ {
-		for y := box_width; y < len(img)-box_width; y++ {
-			for x := box_width; x < len(img[0])-box_width; x++ {
-				var colour geometry.Vec3
-				for dy := -box_width; dy <= box_width; dy++ {
-					for dx := -box_width; dx <= box_width; dx++ {
-						colour.AddInPlace(source[y+dy][x+dx])
-					}
-				}
-				data[y][x] = colour.Mult(factor)
-			}
+// Returns the linear colours of the frame as the R, G and B channels of a
+// float image
+func (f *Frame) HDR() *hdr.Image {
+	img := hdr.NewImage(len(f.Colours[0]), len(f.Colours))
+	addColourChannels(img, "", func(x, y int) geometry.Vec3 { return f.Colours[y][x] })
+	return img
+}
+
+// Adds the colours returned by at to img as the R, G and B channels of
+// layer, or of the image if layer is empty
+func addColourChannels(img *hdr.Image, layer string, at func(x, y int) geometry.Vec3) {
+	if layer != "" {
+		layer += "."
+	}
+	r, g, b := img.Channel(layer+"R"), img.Channel(layer+"G"), img.Channel(layer+"B")
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			colour := at(x, y)
+			i := y*img.Width + x
+			r[i], g[i], b[i] = float32(colour.X), float32(colour.Y), float32(colour.Z)
 		}
-		fmt.Printf("\rPost Processing %3.0f%%   \r", 100*float64(iteration)/float64(depth))
-		source, data = data, source
 	}
-	return source
 }
 
-var Config struct {
-	MinDepth    int
-	NumRays     int
-	Chunks      int
-	GammaFactor float64
-	BloomFactor int
-	Caustics    int
+// Takes the camera samples of every pixel of film with integrator, tile by
+// tile on Config.Workers goroutines, and prints the progress
+func sampleFilm(film *Film, scene *geometry.Scene, integrator Integrator, groups *LightGroups) {
+	startTime := time.Now()
+	numPixels := film.Cols * film.Rows
+	seed := rand.Int63()
+	buffers := make([]TileBuffer, workers())
+	tiles := Tiles(film.Cols, film.Rows)
+	done := make(chan image.Rectangle, len(tiles))
+	go func() {
+		renderTiles(tiles, func(worker, index int, tile image.Rectangle) {
+			buffer := &buffers[worker]
+			buffer.Reset(film, tile)
+			sampler := Samplers[Config.Sampler](Config.NumRays, tileSeed(seed, index))
+			MonteCarloPixel(buffer, scene, integrator, sampler, groups)
+			film.Merge(buffer)
+			done <- tile
+		})
+		close(done)
+	}()
 
-	Skip struct {
-		Top, Left, Right, Bottom int
+	// Print progress information after every tile
+	rendered := 0
+	for tile := range done {
+		rendered += tile.Dx() * tile.Dy()
+		fmt.Printf("\rRendering %6.2f%%", 100*float64(rendered)/float64(numPixels))
+		so_far := time.Now().Sub(startTime)
+		remaining := time.Duration((so_far.Seconds()/float64(rendered))*float64(numPixels-rendered)) * time.Second
+		fmt.Printf(" (Time Remaining: ")
+		PrintDuration(remaining)
+		fmt.Printf(" at %0.1f pps)                \r", float64(rendered)/so_far.Seconds())
 	}
 }
 
-func Render(scene geometry.Scene) image.Image {
-	img := image.NewNRGBA(image.Rect(0, 0, scene.Cols, scene.Rows))
-	pixels := make(chan Result, 128)
-
-	workload := scene.Rows / Config.Chunks
+// Renders scene, and its AOVs if Config.AOVs is set, the passes of the
+// image if Config.Passes is and its light groups if Config.LightBuffers
+// is. The AOVs of the frame are nil otherwise.
+func Render(scene geometry.Scene) *Frame {
+	img := newDisplayImage(scene.Cols, scene.Rows)
 
 	startTime := time.Now()
-	globals /*, caustics*/ := GenerateMaps(scene.Objects)
-	fmt.Println(" Done!")
-	//fmt.Printf("Diffuse Map depth: %v Caustics Map depth: %v\n", globals.Depth(), caustics.Depth())
-	fmt.Printf("Diffuse Map depth: %v\n", globals.Depth())
-	fmt.Printf("Photon Maps Done. Generation took: ")
-	stopTime := time.Now()
-	PrintDuration(stopTime.Sub(startTime))
-	fmt.Println()
+	var globals, caustics *kd.KDNode
+	if UsesPhotonMaps[Config.Integrator] {
+		globals, caustics = GenerateMaps(&scene)
+		fmt.Println(" Done!")
+		fmt.Printf("Diffuse Map depth: %v Caustics Map depth: %v\n", globals.Depth(), caustics.Depth())
+		fmt.Printf("Photon Maps Done. Generation took: ")
+		PrintDuration(time.Now().Sub(startTime))
+		fmt.Println()
+	}
+
+	lights := NewLightSampler(&scene)
+	fmt.Printf("Sampling %v lights with %v shadow rays per hit\n", len(lights.Lights), Config.LightSamples)
+	integrator := Integrators[Config.Integrator](&scene, globals, caustics, lights)
+	fmt.Printf("Using the %v integrator and the %v sampler\n", Config.Integrator, Config.Sampler)
 
 	startTime = time.Now()
-	for y := 0; y < scene.Rows; y += workload {
-		go MonteCarloPixel(pixels, &scene, globals /*caustics,*/, y, workload, rand.New(rand.NewSource(rand.Int63())))
+	frame, isFrame := integrator.(FrameIntegrator)
+	_, hasPasses := integrator.(PassIntegrator)
+	hasPasses = hasPasses && !isFrame
+	if (Config.Passes || Config.LightBuffers) && !hasPasses {
+		fmt.Printf("The %v integrator can't split its light into passes or light groups\n", Config.Integrator)
 	}
-
-	// Write targets for after effects
-	data := make([][]geometry.Vec3, scene.Rows)
-	peaks := make([][]geometry.Vec3, scene.Rows)
-	for i, _ := range data {
-		data[i] = make([]geometry.Vec3, scene.Cols)
-		peaks[i] = make([]geometry.Vec3, scene.Cols)
+	var groups *LightGroups
+	if Config.LightBuffers && hasPasses {
+		groups = NewLightGroups(&scene)
+		fmt.Printf("Writing the light of %v light groups: %v\n", len(groups.Names), strings.Join(groups.Names, ", "))
+	}
+	film := NewFilm(scene.Cols, scene.Rows, NewFilter())
+	numPixels := scene.Rows * scene.Cols
+	if isFrame {
+		frame.RenderFrame(film, rand.New(rand.NewSource(rand.Int63())))
+	} else {
+		sampleFilm(film, &scene, integrator, groups)
 	}
 
-	// Collect results
-	var so_far time.Duration
+	colours := film.Colours()
 	var highest, lowest geometry.Vec3
 	highValue, lowValue := geometry.Float(0), geometry.Float(math.Inf(+1))
-	numPixels := scene.Rows * scene.Cols
-	for i := 0; i < numPixels; i++ {
-		// Print progress information every 500 pixels
-		if i%500 == 0 {
-			fmt.Printf("\rRendering %6.2f%%", 100*float64(i)/float64(scene.Rows*scene.Cols))
-			so_far = time.Now().Sub(startTime)
-			remaining := time.Duration((so_far.Seconds()/float64(i))*float64(numPixels-i)) * time.Second
-			fmt.Printf(" (Time Remaining: ")
-			PrintDuration(remaining)
-			fmt.Printf(" at %0.1f pps)                \r", float64(i)/so_far.Seconds())
+	for y := range colours {
+		for _, colour := range colours[y] {
+			if low := colour.Abs(); low < lowValue {
+				lowValue = low
+				lowest = colour
+			}
+			if high := colour.Abs(); high > highValue {
+				highValue = high
+				highest = colour
+			}
 		}
-		pixel := <-pixels
+	}
+	fmt.Println("\rRendering 100.00%")
+	if Config.MaxRays > Config.NumRays && !isFrame {
+		samples := 0
+		for _, row := range film.Samples() {
+			for _, n := range row {
+				samples += n
+			}
+		}
+		fmt.Printf("Adaptive sampling took %.1f samples per pixel\n", float64(samples)/float64(numPixels))
+	}
 
-		if low := pixel.colour.Abs(); low < lowValue {
-			lowValue = low
-			lowest = pixel.colour
+	if Config.Denoise > 0 {
+		if isFrame {
+			fmt.Printf("The %v integrator collects no features, not denoising\n", Config.Integrator)
+		} else {
+			fmt.Printf("Denoising with %v passes\n", Config.Denoise)
+			colours = Denoise(colours, film.Features(), film.Variance(), Config.Denoise)
 		}
-		if high := pixel.colour.Abs(); high > highValue {
-			highValue = high
-			highest = pixel.colour
+	}
+
+	exposed := make([][]geometry.Vec3, scene.Rows)
+	for y := range colours {
+		exposed[y] = make([]geometry.Vec3, scene.Cols)
+		for x, colour := range colours[y] {
+			exposed[y][x] = expose(colour)
 		}
-		data[pixel.y][pixel.x] = pixel.colour.CLAMPF()
-		peaks[pixel.y][pixel.x] = pixel.colour.PEAKS(0.8)
 	}
-	fmt.Println("\rRendering 100.00%")
+	postStart := time.Now()
+	for _, process := range Config.PostProcessing {
+		exposed = process.Process(exposed)
+	}
 
-	bloomed := BloomFilter(peaks, Config.BloomFactor)
+	// Display referred post processes grade the encoded colours
+	toneMapper := ToneMappers[Config.ToneMapper]
+	display := exposed
+	for y := range display {
+		for x, colour := range display[y] {
+			display[y][x] = EncodeColour(toneMapper(colour))
+		}
+	}
+	for _, process := range Config.DisplayProcessing {
+		display = process.Process(display)
+	}
+	if len(Config.PostProcessing)+len(Config.DisplayProcessing) > 0 {
+		fmt.Printf("Post processing took ")
+		PrintDuration(time.Now().Sub(postStart))
+		fmt.Println()
+	}
 
-	for y := 0; y < len(data); y++ {
-		for x := 0; x < len(data[0]); x++ {
-			colour := data[y][x].Add(bloomed[y][x])
-			colour = CorrectColours(colour).CLAMP()
-			img.SetNRGBA(x, y, color.NRGBA{uint8(colour.X), uint8(colour.Y), uint8(colour.Z), 255})
+	for y := range display {
+		for x, colour := range display[y] {
+			setEncodedColour(img, x, y, colour)
 		}
 	}
-	stopTime = time.Now()
+	stopTime := time.Now()
 	clearLine()
 	fmt.Println("\rDone!")
 	fmt.Printf("Brightest pixel: %v intensity: %v\n", highest, highValue)
@@ -219,5 +440,31 @@ func Render(scene geometry.Scene) image.Image {
 	PrintDuration(stopTime.Sub(startTime))
 	fmt.Println()
 
-	return img
+	var aovs *AOVs
+	if Config.AOVs {
+		if isFrame {
+			// The film holds no camera samples to take the AOVs from
+			fmt.Println("Collecting AOVs")
+			surfaces := NewFilm(scene.Cols, scene.Rows, film.Filter)
+			sampleFilm(surfaces, &scene, surfacesOnly{}, nil)
+			clearLine()
+			aovs = surfaces.AOVs()
+		} else {
+			aovs = film.AOVs()
+			aovs.Samples, aovs.Variance = film.Samples(), film.Variance()
+		}
+	}
+	if Config.Passes && hasPasses {
+		if aovs == nil {
+			aovs = &AOVs{}
+		}
+		aovs.Passes = film.Passes()
+	}
+	if groups != nil {
+		if aovs == nil {
+			aovs = &AOVs{}
+		}
+		aovs.LightGroups, aovs.Lights = groups.Names, film.Lights()
+	}
+	return &Frame{img, colours, aovs}
 }
@@ -0,0 +1,205 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"github.com/Nightgunner5/goray/kd"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+////////////////////
+// Integrators
+////////////////////
+
+// An Integrator computes the light arriving at the camera along a ray.
+// Integrators are shared between the rendering goroutines and must not
+// keep per-ray state.
+type Integrator interface {
+	Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3
+}
+
+type IntegratorFactory func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator
+
+// The integrators selectable by name with Config.Integrator
+var Integrators = map[string]IntegratorFactory{
+	"path": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &PathTracer{scene, diffuseMap, causticsMap, lights}
+	},
+	"direct": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &DirectLighting{scene, lights}
+	},
+	"ao": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &AmbientOcclusion{scene, geometry.Float(Config.AODistance)}
+	},
+	"normals": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &DebugIntegrator{scene, DebugNormals}
+	},
+	"depth": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &DebugIntegrator{scene, DebugDepth}
+	},
+	"albedo": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &DebugIntegrator{scene, DebugAlbedo}
+	},
+	"bdpt": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return NewBDPT(scene, lights)
+	},
+	"mlt": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &MLT{scene, &PathTracer{scene, nil, nil, lights}}
+	},
+	"sppm": func(scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler) Integrator {
+		return &SPPM{scene, lights}
+	},
+}
+
+// The integrators that shade from the photon maps built before rendering
+var UsesPhotonMaps = map[string]bool{
+	"path": true,
+}
+
+// Integrators that need to see the whole image at once, like progressive
+// photon mapping, render the frame themselves and set the colour of every
+// pixel of the film.
+type FrameIntegrator interface {
+	Integrator
+	RenderFrame(film *Film, rand *rand.Rand)
+}
+
+// Returns the names of all integrators in alphabetical order
+func IntegratorNames() []string {
+	var names []string
+	for name := range Integrators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The full path tracer including indirect light
+type PathTracer struct {
+	Scene       *geometry.Scene
+	DiffuseMap  *kd.KDNode
+	CausticsMap *kd.KDNode
+	Lights      *LightSampler
+}
+
+func (p *PathTracer) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	return Radiance(ray, p.Scene, p.DiffuseMap, p.CausticsMap, p.Lights, 0, geometry.Vec3{1, 1, 1}, rand)
+}
+
+func (p *PathTracer) RadiancePasses(ray geometry.Ray, rand *rand.Rand, groups *LightGroups, lights []geometry.Vec3) Passes {
+	var passes Passes
+	path := lightPath{passes: &passes, lights: lights, groups: groups}
+	radiance(ray, p.Scene, p.DiffuseMap, p.CausticsMap, p.Lights, 0, geometry.Vec3{1, 1, 1}, rand, 0, false, path)
+	return passes
+}
+
+// Only light reaching the first diffuse surface straight from an emitter
+// is counted. Mirrors and glass in front of it are followed.
+type DirectLighting struct {
+	Scene  *geometry.Scene
+	Lights *LightSampler
+}
+
+// The longest chain of specular bounces followed by DirectLighting
+const maxSpecularDepth = 8
+
+func (d *DirectLighting) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	scene := d.Scene
+	for depth := 0; depth < maxSpecularDepth; depth++ {
+		shape, distance := ClosestIntersection(scene.Objects, ray)
+		if shape == nil {
+			return missRadiance(ray, scene, d.Lights, 0)
+		}
+		impact := ray.Origin.Add(ray.Direction.Mult(distance))
+		normal := shape.NormalDir(impact).Normalize()
+		outgoing := normal
+		if normal.Dot(ray.Direction) > 0 {
+			outgoing = normal.Mult(-1)
+		}
+
+		if shape.Material != geometry.DIFFUSE {
+			ray = specularBounce(ray, shape, impact, normal, outgoing, rand)
+			continue
+		}
+
+		return shape.Emission.Add(shape.Colour.MultVec(directLighting(impact, outgoing, shape, scene, d.Lights, rand)))
+	}
+	return geometry.Vec3{0, 0, 0}
+}
+
+// Estimates the light arriving straight from emitters and the sky at a
+// diffuse point, divided by pi like EmitterSampling. Light sampling is
+// combined with a single bounce that finds what light sampling is bad at.
+func directLighting(impact, outgoing geometry.Vec3, shape *geometry.Shape, scene *geometry.Scene, lights *LightSampler, rand *rand.Rand) geometry.Vec3 {
+	directLight := EmitterSampling(impact, outgoing, shape, scene, lights, rand)
+
+	bounceDirection, pdf := SampleCosineHemisphere(outgoing, rand)
+	bounceRay := geometry.Ray{impact, bounceDirection}
+	if hit, _ := ClosestIntersection(scene.Objects, bounceRay); hit != nil {
+		directLight.AddInPlace(emittedRadiance(bounceRay, hit, scene, lights, pdf))
+	} else {
+		directLight.AddInPlace(missRadiance(bounceRay, scene, lights, pdf))
+	}
+	return directLight
+}
+
+// Shades surfaces by the fraction of the hemisphere above them that is
+// unoccluded within Distance.
+type AmbientOcclusion struct {
+	Scene    *geometry.Scene
+	Distance geometry.Float
+}
+
+func (a *AmbientOcclusion) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	shape, distance := ClosestIntersection(a.Scene.Objects, ray)
+	if shape == nil {
+		return geometry.Vec3{1, 1, 1}
+	}
+	impact := ray.Origin.Add(ray.Direction.Mult(distance))
+	normal := shape.NormalDir(impact).Normalize()
+	if normal.Dot(ray.Direction) > 0 {
+		normal = normal.Mult(-1)
+	}
+
+	direction, _ := SampleCosineHemisphere(normal, rand)
+	if hit, hitDistance := ClosestIntersection(a.Scene.Objects, geometry.Ray{impact, direction}); hit != nil && hitDistance < a.Distance {
+		return geometry.Vec3{0, 0, 0}
+	}
+	return geometry.Vec3{1, 1, 1}
+}
+
+const (
+	DebugNormals = iota
+	DebugDepth
+	DebugAlbedo
+)
+
+// Shows a property of the first surface hit by every camera ray
+type DebugIntegrator struct {
+	Scene *geometry.Scene
+	Mode  int
+}
+
+func (d *DebugIntegrator) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	shape, distance := ClosestIntersection(d.Scene.Objects, ray)
+	if shape == nil {
+		return geometry.Vec3{0, 0, 0}
+	}
+	impact := ray.Origin.Add(ray.Direction.Mult(distance))
+
+	switch d.Mode {
+	case DebugNormals:
+		// Map the world space normal from [-1, 1] to [0, 1]
+		normal := shape.NormalDir(impact).Normalize()
+		return normal.Add(geometry.Vec3{1, 1, 1}).Mult(0.5)
+	case DebugDepth:
+		// Near surfaces are bright, the far side of the scene is dark
+		_, radius := d.Scene.Bounds()
+		depth := geometry.Float(math.Max(0, 1-float64(distance/(2*radius))))
+		return geometry.Vec3{depth, depth, depth}
+	case DebugAlbedo:
+		return shape.Colour
+	}
+	panic("Unknown debug mode")
+}
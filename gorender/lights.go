@@ -0,0 +1,186 @@
+package gorender
+
+import (
+	"fmt"
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+////////////////////
+// Light selection
+////////////////////
+
+// A Light is an emitter that can be sampled directly. Shape is nil for the
+// sun of the scene's sky.
+type Light struct {
+	Shape *geometry.Shape
+	Power float64
+}
+
+// LightSampler picks lights with a probability proportional to the power
+// they emit, so that scenes with many small lights only need a shadow ray
+// per chosen light instead of one per emitter.
+type LightSampler struct {
+	Lights []Light
+	cdf    []float64
+	index  map[*geometry.Shape]int
+}
+
+func luminance(v geometry.Vec3) float64 {
+	return float64(0.2126*v.X + 0.7152*v.Y + 0.0722*v.Z)
+}
+
+func NewLightSampler(scene *geometry.Scene) *LightSampler {
+	var lights []Light
+
+	for _, shape := range scene.Objects {
+		if shape.Emission.IsZero() {
+			continue
+		}
+		area := float64(shape.Area())
+		if math.IsInf(area, 0) {
+			// Unbounded emitters are only found by bouncing rays
+			continue
+		}
+		lights = append(lights, Light{shape, luminance(shape.Emission) * area * math.Pi})
+	}
+
+	if sky := scene.Sky; sky != nil && !sky.SunIrradiance.IsZero() {
+		_, radius := scene.Bounds()
+		area := math.Pi * float64(radius*radius)
+		lights = append(lights, Light{nil, luminance(sky.SunIrradiance) * area})
+	}
+
+	return newLightSampler(lights)
+}
+
+func newLightSampler(lights []Light) *LightSampler {
+	sampler := &LightSampler{Lights: lights, index: make(map[*geometry.Shape]int)}
+
+	total := 0.0
+	for i, light := range lights {
+		if light.Shape != nil {
+			sampler.index[light.Shape] = i
+		}
+		total += light.Power
+	}
+	sampler.cdf = make([]float64, len(lights))
+	sum := 0.0
+	for i, light := range lights {
+		if total > 0 {
+			sum += light.Power / total
+		} else {
+			sum += 1 / float64(len(lights))
+		}
+		sampler.cdf[i] = sum
+	}
+	return sampler
+}
+
+// Returns a sampler that only picks the lights for which keep is true,
+// with the same relative probabilities.
+func (l *LightSampler) Filter(keep func(*Light) bool) *LightSampler {
+	var lights []Light
+	for i := range l.Lights {
+		if keep(&l.Lights[i]) {
+			lights = append(lights, l.Lights[i])
+		}
+	}
+	return newLightSampler(lights)
+}
+
+// Picks a light and returns it together with the probability of choosing
+// it. Returns nil if there are no lights in the scene.
+func (l *LightSampler) Sample(rand *rand.Rand) (*Light, float64) {
+	if len(l.Lights) == 0 {
+		return nil, 0
+	}
+	i := sort.SearchFloat64s(l.cdf, rand.Float64())
+	if i >= len(l.Lights) {
+		i = len(l.Lights) - 1
+	}
+	return &l.Lights[i], l.probability(i)
+}
+
+func (l *LightSampler) probability(i int) float64 {
+	if i == 0 {
+		return l.cdf[0]
+	}
+	return l.cdf[i] - l.cdf[i-1]
+}
+
+// The probability of Sample picking the light for shape, or the sun if
+// shape is nil.
+func (l *LightSampler) Pdf(shape *geometry.Shape) float64 {
+	if shape == nil {
+		if n := len(l.Lights); n > 0 && l.Lights[n-1].Shape == nil {
+			return l.probability(n - 1)
+		}
+		return 0
+	}
+	if i, ok := l.index[shape]; ok {
+		return l.probability(i)
+	}
+	return 0
+}
+
+////////////////////
+// Light groups
+////////////////////
+
+// LightGroups assign every emitter of the scene, and its sky, to one of the
+// buffers that the light found along paths is split into, so that lights
+// can be rebalanced after rendering. Config.LightGroups names groups of
+// objects by their index in the scene, starting at one as in the object
+// AOV, with zero for the sky. Emitters in no group get a buffer of their
+// own.
+type LightGroups struct {
+	Names  []string
+	groups map[*geometry.Shape]int
+	sky    int
+}
+
+func NewLightGroups(scene *geometry.Scene) *LightGroups {
+	groups := &LightGroups{groups: make(map[*geometry.Shape]int), sky: -1}
+	var names []string
+	for name := range Config.LightGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, index := range Config.LightGroups[name] {
+			if index == 0 {
+				groups.sky = len(groups.Names)
+			} else if index <= len(scene.Objects) {
+				groups.groups[scene.Objects[index-1]] = len(groups.Names)
+			}
+		}
+		groups.Names = append(groups.Names, name)
+	}
+
+	for i, shape := range scene.Objects {
+		if _, ok := groups.groups[shape]; !ok && !shape.Emission.IsZero() {
+			groups.groups[shape] = len(groups.Names)
+			groups.Names = append(groups.Names, fmt.Sprintf("light%v", i+1))
+		}
+	}
+	if groups.sky < 0 && scene.Sky != nil {
+		groups.sky = len(groups.Names)
+		groups.Names = append(groups.Names, "sky")
+	}
+	return groups
+}
+
+// Returns the group of the light emitted by shape, or by the sky if shape
+// is nil. Returns -1 if it is in none.
+func (g *LightGroups) Group(shape *geometry.Shape) int {
+	if shape == nil {
+		return g.sky
+	}
+	if group, ok := g.groups[shape]; ok {
+		return group
+	}
+	return -1
+}
@@ -0,0 +1,152 @@
+package gorender
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+////////////////////
+// Lookup tables
+////////////////////
+
+// A colour lookup table from a .cube file, either one table per channel or
+// a cube indexed by all three
+type CubeLUT struct {
+	Size      int
+	ThreeD    bool
+	DomainMin geometry.Vec3
+	DomainMax geometry.Vec3
+	Table     []geometry.Vec3
+}
+
+// Reads a 1D or 3D lookup table in the .cube format
+func LoadCube(filename string) (*CubeLUT, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lut := &CubeLUT{DomainMax: geometry.Vec3{1, 1, 1}}
+	parseVec3 := func(fields []string) (geometry.Vec3, error) {
+		var v [3]float64
+		if len(fields) != 3 {
+			return geometry.Vec3{}, fmt.Errorf("expected 3 values, found %v", len(fields))
+		}
+		for i, field := range fields {
+			if v[i], err = strconv.ParseFloat(field, 64); err != nil {
+				return geometry.Vec3{}, err
+			}
+		}
+		return geometry.Vec3{geometry.Float(v[0]), geometry.Float(v[1]), geometry.Float(v[2])}, nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "TITLE":
+		case "LUT_1D_SIZE", "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%v:%v: expected a size", filename, line)
+			}
+			if lut.Size, err = strconv.Atoi(fields[1]); err != nil || lut.Size < 2 {
+				return nil, fmt.Errorf("%v:%v: bad size %q", filename, line, fields[1])
+			}
+			lut.ThreeD = fields[0] == "LUT_3D_SIZE"
+		case "DOMAIN_MIN":
+			if lut.DomainMin, err = parseVec3(fields[1:]); err != nil {
+				return nil, fmt.Errorf("%v:%v: %v", filename, line, err)
+			}
+		case "DOMAIN_MAX":
+			if lut.DomainMax, err = parseVec3(fields[1:]); err != nil {
+				return nil, fmt.Errorf("%v:%v: %v", filename, line, err)
+			}
+		// The same domain for all channels, as written by Resolve
+		case "LUT_1D_INPUT_RANGE", "LUT_3D_INPUT_RANGE":
+			var bounds [2]float64
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%v:%v: expected a minimum and a maximum", filename, line)
+			}
+			for i, field := range fields[1:] {
+				if bounds[i], err = strconv.ParseFloat(field, 64); err != nil {
+					return nil, fmt.Errorf("%v:%v: %v", filename, line, err)
+				}
+			}
+			min, max := geometry.Float(bounds[0]), geometry.Float(bounds[1])
+			lut.DomainMin, lut.DomainMax = geometry.Vec3{min, min, min}, geometry.Vec3{max, max, max}
+		default:
+			colour, err := parseVec3(fields)
+			if err != nil {
+				return nil, fmt.Errorf("%v:%v: %v", filename, line, err)
+			}
+			lut.Table = append(lut.Table, colour)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := lut.Size
+	if lut.ThreeD {
+		entries = lut.Size * lut.Size * lut.Size
+	}
+	if lut.Size == 0 || len(lut.Table) != entries {
+		return nil, fmt.Errorf("%v: expected %v entries, found %v", filename, entries, len(lut.Table))
+	}
+	if lut.DomainMax.X <= lut.DomainMin.X || lut.DomainMax.Y <= lut.DomainMin.Y || lut.DomainMax.Z <= lut.DomainMin.Z {
+		return nil, fmt.Errorf("%v: the domain from %v to %v is empty", filename, lut.DomainMin, lut.DomainMax)
+	}
+	return lut, nil
+}
+
+// Looks colour up in the table, interpolating linearly between its
+// entries. Colours outside the domain are clamped to it, and NaN to its
+// minimum.
+func (lut *CubeLUT) Apply(colour geometry.Vec3) geometry.Vec3 {
+	// The position of a channel in the table, split into the entry below
+	// it and the distance to the next one
+	position := func(v, min, max geometry.Float) (int, geometry.Float) {
+		scaled := float64((v-min)/(max-min)) * float64(lut.Size-1)
+		if math.IsNaN(scaled) {
+			scaled = 0
+		}
+		scaled = math.Max(0, math.Min(float64(lut.Size-1), scaled))
+		i := int(scaled)
+		if i == lut.Size-1 {
+			i--
+		}
+		return i, geometry.Float(scaled) - geometry.Float(i)
+	}
+	r, fr := position(colour.X, lut.DomainMin.X, lut.DomainMax.X)
+	g, fg := position(colour.Y, lut.DomainMin.Y, lut.DomainMax.Y)
+	b, fb := position(colour.Z, lut.DomainMin.Z, lut.DomainMax.Z)
+
+	if !lut.ThreeD {
+		lerp := func(i int, f geometry.Float) geometry.Vec3 {
+			return lut.Table[i].Mult(1 - f).Add(lut.Table[i+1].Mult(f))
+		}
+		return geometry.Vec3{lerp(r, fr).X, lerp(g, fg).Y, lerp(b, fb).Z}
+	}
+
+	// Red changes fastest in the table, blue slowest
+	n := lut.Size
+	at := func(r, g, b int) geometry.Vec3 {
+		return lut.Table[(b*n+g)*n+r]
+	}
+	lerpR := func(g, b int) geometry.Vec3 {
+		return at(r, g, b).Mult(1 - fr).Add(at(r+1, g, b).Mult(fr))
+	}
+	lerpG := func(b int) geometry.Vec3 {
+		return lerpR(g, b).Mult(1 - fg).Add(lerpR(g+1, b).Mult(fg))
+	}
+	return lerpG(b).Mult(1 - fb).Add(lerpG(b + 1).Mult(fb))
+}
@@ -0,0 +1,105 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func closeTo(a, b geometry.Vec3) bool {
+	const epsilon = 1e-5
+	return math.Abs(float64(a.X-b.X)) < epsilon &&
+		math.Abs(float64(a.Y-b.Y)) < epsilon &&
+		math.Abs(float64(a.Z-b.Z)) < epsilon
+}
+
+func TestLoadCube(t *testing.T) {
+	cube := "0 0 0\n1 0 0\n0 1 0\n1 1 0\n0 0 1\n1 0 1\n0 1 1\n1 1 1\n"
+	tests := []struct {
+		name, file string
+		ok         bool
+		size       int
+		threeD     bool
+		min, max   geometry.Vec3
+	}{
+		{"1D", "LUT_1D_SIZE 2\n0 0 0\n1 1 1\n", true, 2, false, geometry.Vec3{0, 0, 0}, geometry.Vec3{1, 1, 1}},
+		{"3D", "TITLE \"identity\"\n# comment\n\nLUT_3D_SIZE 2\n" + cube, true, 2, true, geometry.Vec3{0, 0, 0}, geometry.Vec3{1, 1, 1}},
+		{"domain", "LUT_3D_SIZE 2\nDOMAIN_MIN 0 -1 0\nDOMAIN_MAX 1 2 4\n" + cube, true, 2, true, geometry.Vec3{0, -1, 0}, geometry.Vec3{1, 2, 4}},
+		{"input range", "LUT_3D_SIZE 2\nLUT_3D_INPUT_RANGE 0 2\n" + cube, true, 2, true, geometry.Vec3{0, 0, 0}, geometry.Vec3{2, 2, 2}},
+		{"no size", "0 0 0\n1 1 1\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+		{"size too small", "LUT_1D_SIZE 1\n0 0 0\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+		{"bad size", "LUT_1D_SIZE two\n0 0 0\n1 1 1\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+		{"missing entries", "LUT_3D_SIZE 2\n0 0 0\n1 1 1\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+		{"short entry", "LUT_1D_SIZE 2\n0 0\n1 1 1\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+		{"bad value", "LUT_1D_SIZE 2\n0 x 0\n1 1 1\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+		{"empty domain", "LUT_1D_SIZE 2\nDOMAIN_MIN 0 1 0\nDOMAIN_MAX 1 1 1\n0 0 0\n1 1 1\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+		{"reversed input range", "LUT_1D_SIZE 2\nLUT_1D_INPUT_RANGE 1 0\n0 0 0\n1 1 1\n", false, 0, false, geometry.Vec3{}, geometry.Vec3{}},
+	}
+
+	for _, test := range tests {
+		file, err := ioutil.TempFile("", "lut")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(test.file)
+		file.Close()
+		lut, err := LoadCube(file.Name())
+		os.Remove(file.Name())
+
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%v: LoadCube succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: LoadCube failed: %v", test.name, err)
+			continue
+		}
+		if lut.Size != test.size || lut.ThreeD != test.threeD || lut.DomainMin != test.min || lut.DomainMax != test.max {
+			t.Errorf("%v: got size %v, 3D %v, domain %v to %v, want size %v, 3D %v, domain %v to %v", test.name,
+				lut.Size, lut.ThreeD, lut.DomainMin, lut.DomainMax, test.size, test.threeD, test.min, test.max)
+		}
+	}
+}
+
+func TestCubeLUTApply(t *testing.T) {
+	curve := &CubeLUT{
+		Size:      3,
+		DomainMax: geometry.Vec3{1, 1, 1},
+		Table:     []geometry.Vec3{{0, 0, 0}, {0.25, 0.5, 1}, {1, 1, 1}},
+	}
+	// Swaps red and blue
+	var swapped []geometry.Vec3
+	for b := 0; b < 2; b++ {
+		for g := 0; g < 2; g++ {
+			for r := 0; r < 2; r++ {
+				swapped = append(swapped, geometry.Vec3{geometry.Float(b), geometry.Float(g), geometry.Float(r)})
+			}
+		}
+	}
+	swap := &CubeLUT{Size: 2, ThreeD: true, DomainMax: geometry.Vec3{1, 1, 1}, Table: swapped}
+	wide := &CubeLUT{Size: 2, ThreeD: true, DomainMax: geometry.Vec3{2, 2, 2}, Table: swapped}
+	nan := geometry.Float(math.NaN())
+
+	tests := []struct {
+		name           string
+		lut            *CubeLUT
+		colour, result geometry.Vec3
+	}{
+		{"1D entries", curve, geometry.Vec3{0, 0.5, 1}, geometry.Vec3{0, 0.5, 1}},
+		{"1D between entries", curve, geometry.Vec3{0.5, 0.25, 0.75}, geometry.Vec3{0.25, 0.25, 1}},
+		{"1D clamped", curve, geometry.Vec3{-1, 2, nan}, geometry.Vec3{0, 1, 0}},
+		{"3D corner", swap, geometry.Vec3{1, 0, 0}, geometry.Vec3{0, 0, 1}},
+		{"3D between entries", swap, geometry.Vec3{0.2, 0.6, 0.9}, geometry.Vec3{0.9, 0.6, 0.2}},
+		{"3D clamped", swap, geometry.Vec3{2, -1, nan}, geometry.Vec3{0, 0, 1}},
+		{"3D domain", wide, geometry.Vec3{1, 0.5, 2}, geometry.Vec3{1, 0.25, 0.5}},
+	}
+	for _, test := range tests {
+		if result := test.lut.Apply(test.colour); !closeTo(result, test.result) {
+			t.Errorf("%v: Apply(%v) = %v, want %v", test.name, test.colour, result, test.result)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package gorender
+
+import (
+	"fmt"
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+/////////////////////////////////////////
+// Primary sample space Metropolis
+/////////////////////////////////////////
+
+// MLT renders with primary sample space Metropolis light transport
+// (Kelemen et al., 2002). Every random number the path tracer draws for a
+// sample, starting with the pixel, comes from a stream that is mutated
+// instead of drawn anew. Mutations that find more light are kept more
+// often, so once a chain has found a rare bright path, like a caustic
+// seen through a mirror, it explores the paths around it.
+//
+// A bootstrap phase of independent samples estimates the brightness of
+// the whole image, which scales the result, and picks the starting points
+// of the chains. It takes a tenth as many samples as there are mutations,
+// within mltMinBootstrap and mltMaxBootstrap. Config.NumRays sets the
+// mutations per pixel and every chain runs on its own goroutine, one per
+// worker but at least mltChains.
+type MLT struct {
+	Scene      *geometry.Scene
+	Integrator Integrator
+}
+
+const (
+	mltMinBootstrap = 10000  // The fewest independent samples to normalise with
+	mltMaxBootstrap = 100000 // And the most
+	mltLargeStep    = 0.3    // Probability of replacing the whole stream
+	mltSigma        = 0.01   // Standard deviation of small mutations
+	mltChains       = 8      // The fewest chains, each from its own start
+)
+
+func (m *MLT) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	return m.Integrator.Radiance(ray, rand)
+}
+
+// A random number of the stream with the iteration it was last changed
+// in, and the value it had before in case the mutation is rejected.
+type primarySample struct {
+	value, backup            float64
+	modified, backupModified int
+}
+
+// primarySource is a rand.Source that hands out a stream of primary
+// samples and mutates them lazily. Samples are only brought up to date
+// when they are drawn, so paths of any length cost nothing extra.
+type primarySource struct {
+	samples []primarySample
+	index   int
+
+	iteration, lastLargeStep int
+	largeStep                bool
+	rand                     *rand.Rand
+}
+
+func newPrimarySource(seed int64) *primarySource {
+	// The first iteration draws every sample fresh. Samples that are new
+	// to the stream count as modified in iteration zero, before it, so
+	// they are drawn fresh as well.
+	return &primarySource{rand: rand.New(rand.NewSource(seed)), iteration: 1, largeStep: true}
+}
+
+func (p *primarySource) Seed(seed int64) {
+	panic("primary sample streams can't be reseeded")
+}
+
+func (p *primarySource) Int63() int64 {
+	return int64(p.next() * (1 << 63))
+}
+
+func (p *primarySource) next() float64 {
+	if p.index == len(p.samples) {
+		p.samples = append(p.samples, primarySample{})
+	}
+	sample := &p.samples[p.index]
+	p.index++
+
+	// Samples that weren't drawn since the last large step would have
+	// been replaced by it
+	if sample.modified < p.lastLargeStep {
+		sample.value = p.rand.Float64()
+		sample.modified = p.lastLargeStep
+	}
+
+	sample.backup, sample.backupModified = sample.value, sample.modified
+	if p.largeStep {
+		sample.value = p.rand.Float64()
+	} else {
+		// Catch up on the small steps missed since the sample was drawn
+		steps := float64(p.iteration - sample.modified)
+		sample.value += p.rand.NormFloat64() * mltSigma * math.Sqrt(steps)
+		sample.value -= math.Floor(sample.value)
+		// Tiny negative values wrap around to exactly 1
+		sample.value = math.Min(sample.value, 1-1.0/(1<<53))
+	}
+	sample.modified = p.iteration
+	return sample.value
+}
+
+// Starts a new mutation
+func (p *primarySource) mutate() {
+	p.iteration++
+	p.largeStep = p.rand.Float64() < mltLargeStep
+	p.index = 0
+}
+
+func (p *primarySource) accept() {
+	if p.largeStep {
+		p.lastLargeStep = p.iteration
+	}
+}
+
+func (p *primarySource) reject() {
+	for i := range p.samples {
+		if sample := &p.samples[i]; sample.modified == p.iteration {
+			sample.value, sample.modified = sample.backup, sample.backupModified
+		}
+	}
+	p.iteration--
+}
+
+// A sample of the image: the position on the film chosen by the stream and
+// the light found through it.
+type mltSample struct {
+	x, y     float64
+	radiance geometry.Vec3
+	weight   float64
+}
+
+// Runs the path tracer on the current state of the stream
+func (m *MLT) sample(source *primarySource) mltSample {
+	scene := m.Scene
+	source.index = 0
+	stream := rand.New(source)
+	filmX := stream.Float64() * float64(scene.Cols)
+	filmY := stream.Float64() * float64(scene.Rows)
+	x, y := int(filmX), int(filmY)
+	if Skipped(scene, x, y) {
+		return mltSample{filmX, filmY, geometry.Vec3{}, 0}
+	}
+	// Rays through a pixel count dy upwards from the bottom of the pixel
+	dx, dy := geometry.Float(filmX)-geometry.Float(x), geometry.Float(y+1)-geometry.Float(filmY)
+	ray := pixelRay(scene, x, y, dx, dy)
+	radiance := m.Integrator.Radiance(ray, stream)
+	return mltSample{filmX, filmY, radiance, luminance(radiance)}
+}
+
+func (m *MLT) RenderFrame(film *Film, source *rand.Rand) {
+	scene := m.Scene
+	numPixels := scene.Rows * scene.Cols
+
+	bootstrap := Config.NumRays * numPixels / 10
+	if bootstrap < mltMinBootstrap {
+		bootstrap = mltMinBootstrap
+	}
+	if bootstrap > mltMaxBootstrap {
+		bootstrap = mltMaxBootstrap
+	}
+	fmt.Printf("Metropolis bootstrap with %v samples\n", bootstrap)
+	seeds := make([]int64, bootstrap)
+	for i := range seeds {
+		seeds[i] = source.Int63()
+	}
+	weights := make([]float64, bootstrap)
+	var wg sync.WaitGroup
+	chains := workers()
+	if chains < mltChains {
+		chains = mltChains
+	}
+	for chain := 0; chain < chains; chain++ {
+		wg.Add(1)
+		go func(chain int) {
+			for i := chain; i < bootstrap; i += chains {
+				weights[i] = m.sample(newPrimarySource(seeds[i])).weight
+			}
+			wg.Done()
+		}(chain)
+	}
+	wg.Wait()
+
+	cdf := make([]float64, bootstrap)
+	total := 0.0
+	for i, weight := range weights {
+		total += weight
+		cdf[i] = total
+	}
+	brightness := total / float64(bootstrap)
+	if total == 0 {
+		// The film stays black
+		fmt.Println("Metropolis bootstrap found no light")
+		return
+	}
+
+	// Every mutation lands on a pixel with a probability proportional to
+	// its brightness, scale to the brightness the bootstrap found
+	mutations := Config.NumRays * numPixels / chains
+	if mutations < 1 {
+		mutations = 1
+	}
+	scale := brightness * float64(numPixels) / float64(mutations*chains)
+	for chain := 0; chain < chains; chain++ {
+		// Start every chain at a bootstrap sample chosen by its brightness
+		start := sort.SearchFloat64s(cdf, source.Float64()*total)
+		if start >= bootstrap {
+			start = bootstrap - 1
+		}
+
+		wg.Add(1)
+		go func(seed int64) {
+			m.chain(film, newPrimarySource(seed), mutations, scale)
+			wg.Done()
+		}(seeds[start])
+	}
+	wg.Wait()
+}
+
+// Runs a Markov chain from the state of source and splats the light of
+// every state it visits onto film, normalised by its brightness and
+// multiplied by scale.
+func (m *MLT) chain(film *Film, source *primarySource, mutations int, scale float64) {
+	splat := func(sample mltSample, weight float64) {
+		if sample.weight > 0 && weight > 0 {
+			film.Splat(sample.x, sample.y, sample.radiance.Mult(geometry.Float(weight*scale/sample.weight)))
+		}
+	}
+
+	current := m.sample(source)
+	source.accept()
+	for i := 0; i < mutations; i++ {
+		source.mutate()
+		proposed := m.sample(source)
+
+		accept := 1.0
+		if current.weight > 0 {
+			accept = math.Min(1, proposed.weight/current.weight)
+		}
+		// Both states are splatted by their expected share of the time the
+		// chain spends in them, which lowers the noise of rejections
+		splat(proposed, accept)
+		splat(current, 1-accept)
+
+		if source.rand.Float64() < accept {
+			current = proposed
+			source.accept()
+		} else {
+			source.reject()
+		}
+	}
+}
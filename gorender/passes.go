@@ -0,0 +1,165 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"math/rand"
+)
+
+//////////////////////////////
+// Light path expressions
+//////////////////////////////
+
+// The additive passes an image is split into by the events along the path
+// from the camera. Together they sum to the image.
+const (
+	EmissionPass        = iota // Emitters and the sky seen directly
+	DirectDiffusePass          // Light reaching the first diffuse surface straight from an emitter
+	IndirectDiffusePass        // Light reaching the first diffuse surface after more bounces
+	SpecularPass               // Everything seen in mirrors and reflected by glass
+	TransmissionPass           // Everything seen through glass
+	NumPasses
+)
+
+// The names of the passes, used for their files
+var PassNames = [NumPasses]string{"emission", "direct_diffuse", "indirect_diffuse", "specular", "transmission"}
+
+type Passes [NumPasses]geometry.Vec3
+
+func (p *Passes) add(other Passes) {
+	for i := range p {
+		p[i].AddInPlace(other[i])
+	}
+}
+
+func (p Passes) scale(factor geometry.Float) Passes {
+	for i := range p {
+		p[i] = p[i].Mult(factor)
+	}
+	return p
+}
+
+// Returns the image the passes add up to
+func (p Passes) Sum() geometry.Vec3 {
+	var sum geometry.Vec3
+	for _, pass := range p {
+		sum.AddInPlace(pass)
+	}
+	return sum
+}
+
+// Integrators that can split the light they find into passes, and into
+// the light groups it came from. The passes of a ray sum to its radiance.
+// If lights isn't nil, the light found is added to it by group as well.
+type PassIntegrator interface {
+	Integrator
+	RadiancePasses(ray geometry.Ray, rand *rand.Rand, groups *LightGroups, lights []geometry.Vec3) Passes
+}
+
+// The events along a path so far, as far as they decide its pass
+type pathEvent int
+
+const (
+	eventCamera       pathEvent = iota // Nothing hit yet
+	eventDiffuse                       // Bounced once off the first surface, which is diffuse
+	eventIndirect                      // Bounced more than once off the first surface
+	eventSpecular                      // Reflected off the first surface, a mirror or glass
+	eventTransmission                  // Passed through the first surface, glass
+)
+
+// lightPath records the light found along a path into the pass its events
+// belong to, and into the buffer of the group of the light it came from.
+// The light is weighted by the throughput of the path, so recording
+// everything the path finds adds up to its radiance. The zero value records
+// nothing.
+type lightPath struct {
+	passes *Passes
+	lights []geometry.Vec3
+	groups *LightGroups
+	event  pathEvent
+}
+
+// Records light emitted towards the path by emitter, or by the sky if
+// emitter is nil
+func (l lightPath) emitted(emitter *geometry.Shape, light, throughput geometry.Vec3) {
+	if l.passes != nil {
+		l.passes[emittedPass[l.event]].AddInPlace(light.MultVec(throughput))
+	}
+	l.fromLight(emitter, light, throughput)
+}
+
+// Records light that came from emitter in its light group
+func (l lightPath) fromLight(emitter *geometry.Shape, light, throughput geometry.Vec3) {
+	if l.lights == nil {
+		return
+	}
+	if group := l.groups.Group(emitter); group >= 0 {
+		l.lights[group].AddInPlace(light.MultVec(throughput))
+	}
+}
+
+// Returns a function recording the light samples of emitterSampling at a
+// surface with the given albedo in their light groups, or nil if lights
+// aren't recorded
+func (l lightPath) lightSamples(albedo, throughput geometry.Vec3) func(*Light, geometry.Vec3) {
+	if l.lights == nil {
+		return nil
+	}
+	return func(light *Light, sample geometry.Vec3) {
+		l.fromLight(light.Shape, albedo.MultVec(sample), throughput)
+	}
+}
+
+// Returns a function recording the photons gathered by photonRadiance in
+// the light groups they came from, or nil if lights aren't recorded
+func (l lightPath) photons(throughput geometry.Vec3) func(PhotonHit, geometry.Vec3) {
+	if l.lights == nil {
+		return nil
+	}
+	return func(photon PhotonHit, radiance geometry.Vec3) {
+		l.fromLight(photon.Light, radiance, throughput)
+	}
+}
+
+// The pass of emitted light by the events of the path that finds it
+var emittedPass = [...]int{
+	eventCamera:       EmissionPass,
+	eventDiffuse:      DirectDiffusePass,
+	eventIndirect:     IndirectDiffusePass,
+	eventSpecular:     SpecularPass,
+	eventTransmission: TransmissionPass,
+}
+
+// Records light scattered towards the path by the diffuse surface it hit,
+// direct if it came straight from an emitter. Its lights are recorded by
+// lightSamples and photons.
+func (l lightPath) scattered(light, throughput geometry.Vec3, direct bool) {
+	if l.passes == nil {
+		return
+	}
+	pass := IndirectDiffusePass
+	switch {
+	case l.event == eventCamera && direct:
+		pass = DirectDiffusePass
+	case l.event == eventSpecular:
+		pass = SpecularPass
+	case l.event == eventTransmission:
+		pass = TransmissionPass
+	}
+	l.passes[pass].AddInPlace(light.MultVec(throughput))
+}
+
+// Returns the path continued by a bounce off material, transmitted if it
+// passed through the surface
+func (l lightPath) bounce(material int, transmitted bool) lightPath {
+	switch {
+	case l.event == eventCamera && material == geometry.DIFFUSE:
+		l.event = eventDiffuse
+	case l.event == eventCamera && transmitted:
+		l.event = eventTransmission
+	case l.event == eventCamera:
+		l.event = eventSpecular
+	case l.event == eventDiffuse:
+		l.event = eventIndirect
+	}
+	return l
+}
@@ -14,122 +14,60 @@ import (
 type PhotonHit struct {
 	Location, Photon, Incomming geometry.Vec3
 	Depth                       uint8
+	Light                       *geometry.Shape // The emitter, nil for the sun and sky
 }
 
 func (p PhotonHit) Position() geometry.Vec3 {
 	return p.Location
 }
 
-type RayFunc func([]*geometry.Shape, *geometry.Shape, geometry.Ray, geometry.Vec3, chan<- PhotonHit, geometry.Float, int, *rand.Rand)
+type RayFunc func([]*geometry.Shape, *geometry.Shape, geometry.Ray, geometry.Vec3, chan<- PhotonHit, int, *rand.Rand)
 
-/*func CausticPhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometry.Ray, colour geometry.Vec3, result chan<- PhotonHit, alpha float64, depth int, rand *rand.Rand) {
-	if rand.Float64() > alpha {
+// Photons are absorbed after this many bounces even if they survived
+// russian roulette
+const maxPhotonDepth = 16
+
+// Traces a photon that left an emitter towards a specular or refractive
+// shape. It is stored at the first diffuse surface it reaches after at
+// least one specular bounce, photons hitting a diffuse surface straight
+// away are not caustics and are dropped.
+func CausticPhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometry.Ray, power geometry.Vec3, result chan<- PhotonHit, depth int, rand *rand.Rand) {
+	if depth > maxPhotonDepth {
 		return
 	}
 	if shape, distance := ClosestIntersection(scene, ray); shape != nil {
 		impact := ray.Origin.Add(ray.Direction.Mult(distance))
-		if emitter == shape {
+		if depth == 0 && emitter == shape {
 			// Leave the emitter first
 			nextRay := geometry.Ray{impact, ray.Direction}
-			CausticPhoton(scene, emitter, nextRay, colour, result, alpha, depth, rand)
-		} else {
-			normal := shape.NormalDir(impact).Normalize()
-			reverse := ray.Direction.Mult(-1)
-			outgoing := normal
-			if normal.Dot(reverse) < 0 {
-				outgoing = normal.Mult(-1)
-			}
-			//fmt.Println("Hit something else!")
-			if depth > 0 {
-				strength := colour.Mult(1.0 / (alpha + distance))
-				result <- PhotonHit{impact, strength, ray.Direction, uint8(depth)}
-			}
+			CausticPhoton(scene, emitter, nextRay, power, result, depth, rand)
+			return
+		}
 
-			// Specular objects makes reflections
-			if shape.Material == geometry.SPECULAR {
-				reflection := ray.Direction.Sub(normal.Mult(2 * outgoing.Dot(ray.Direction)))
-				reflectedRay := geometry.Ray{impact, reflection.Normalize()}
-				CausticPhoton(scene, shape, reflectedRay, colour, result, alpha*0.9, depth+1, rand)
+		if shape.Material == geometry.DIFFUSE {
+			if depth > 0 {
+				result <- PhotonHit{Location: impact, Photon: power, Incomming: ray.Direction, Depth: uint8(depth)}
 			}
+			return
+		}
 
-			// Refracting objects makes refractions
-			if shape.Material == geometry.REFRACTIVE {
-				var n1, n2 float64
-				var into bool
-				if normal.Dot(outgoing) < 0 {
-					// Leave the glass
-					n1, n2 = GLASS, AIR
-					into = false
-				} else {
-					n1, n2 = AIR, GLASS
-					into = true
-				}
-
-				factor := n1 / n2
-				cosTi := normal.Dot(reverse)
-				sinTi := math.Sqrt(1 - cosTi*cosTi) // sin² + cos² = 1
-				sqrt := math.Sqrt(math.Max(1.0-math.Pow(factor*sinTi, 2), 0))
-				// Rs
-				top := n1*cosTi - n2*sqrt
-				bottom := n1*cosTi + n2*sqrt
-				Rs := math.Pow(top/bottom, 2)
-				// Rp
-				top = n1*sqrt - n2*cosTi
-				bottom = n1*sqrt + n2*cosTi
-				Rp := math.Pow(top/bottom, 2)
-
-				R := (Rs*Rs + Rp*Rp) / 2.0
-				T := 1.0 - R
-				R = math.Pow((n1-n2)/(n1+n2), 2)
-				T = 1.0 - R
-
-				if math.IsNaN(R) {
-					fmt.Printf("into: %v, sqrt: %v\n", into, sqrt)
-					fmt.Printf("cos: %v, sin: %v\n", cosTi, sinTi)
-					fmt.Printf("n1: %v, n2: %v\n", n1, n2)
-					fmt.Printf("Top: %v, Bottom: %v\n", top, bottom)
-					fmt.Printf("Rs: %v, Rp: %v\n", Rs, Rp)
-					fmt.Printf("R: %v, T: %v\n", R, T)
-					return
-				}
-
-				totalReflection := false
-				if n1 > n2 {
-					maxAngle := math.Asin(n2 / n1)
-					actualAngle := math.Asin(sinTi)
-
-					if actualAngle > maxAngle {
-						totalReflection = true
-					}
-					totalReflection = totalReflection
-				}
-
-				if totalReflection {
-					reflectionDirection := ray.Direction.Sub(normal.Mult(2 * normal.Dot(ray.Direction)))
-					reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-					CausticPhoton(scene, emitter, reflectedRay, colour, result, alpha*0.9, depth+1, rand)
-				} else {
-					reflectionDirection := ray.Direction.Sub(normal.Mult(2 * normal.Dot(ray.Direction)))
-					reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-					CausticPhoton(scene, emitter, reflectedRay, colour.Mult(R), result, alpha*0.9, depth+1, rand)
-
-					nDotI := normal.Dot(ray.Direction)
-					trasmittedDirection := ray.Direction.Mult(factor)
-					term2 := factor * nDotI
-					term3 := math.Sqrt(1 - factor*factor*(1-nDotI*nDotI))
-
-					trasmittedDirection = trasmittedDirection.Add(normal.Mult(term2 - term3))
-
-					transmittedRay := geometry.Ray{impact, trasmittedDirection.Normalize()}
-					CausticPhoton(scene, emitter, transmittedRay, colour.Mult(T), result, alpha*0.9, depth+1, rand)
-				}
-			}
+		// Specular objects makes reflections, refracting objects
+		// makes refractions
+		normal := shape.NormalDir(impact).Normalize()
+		outgoing := normal
+		if normal.Dot(ray.Direction) > 0 {
+			outgoing = normal.Mult(-1)
 		}
+		nextRay := specularBounce(ray, shape, impact, normal, outgoing, rand)
+		CausticPhoton(scene, shape, nextRay, power, result, depth+1, rand)
 	}
-}*/
+}
 
-func DiffusePhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometry.Ray, colour geometry.Vec3, result chan<- PhotonHit, alpha geometry.Float, depth int, rand *rand.Rand) {
-	if geometry.Float(rand.Float32()) > alpha {
+// Traces a photon carrying power through the scene and stores it at every
+// diffuse surface it hits, continuing with a probability equal to the
+// surface's albedo so that surviving photons keep their power.
+func DiffusePhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometry.Ray, power geometry.Vec3, result chan<- PhotonHit, depth int, rand *rand.Rand) {
+	if depth > maxPhotonDepth {
 		return
 	}
 	if shape, distance := ClosestIntersection(scene, ray); shape != nil {
@@ -138,7 +76,7 @@ func DiffusePhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometr
 		if depth == 0 && emitter == shape {
 			// Leave the emitter first
 			nextRay := geometry.Ray{impact, ray.Direction}
-			DiffusePhoton(scene, emitter, nextRay, colour, result, alpha, depth, rand)
+			DiffusePhoton(scene, emitter, nextRay, power, result, depth, rand)
 		} else {
 			normal := shape.NormalDir(impact).Normalize()
 			reverse := ray.Direction.Mult(-1)
@@ -146,54 +84,132 @@ func DiffusePhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometr
 			if normal.Dot(reverse) < 0 {
 				outgoing = normal.Mult(-1)
 			}
-			strength := colour.Mult(alpha / (1 + distance))
-			result <- PhotonHit{impact, strength, ray.Direction, uint8(depth)}
 
 			if shape.Material == geometry.DIFFUSE {
+				result <- PhotonHit{Location: impact, Photon: power, Incomming: ray.Direction, Depth: uint8(depth)}
+
 				// Random bounce for color bleeding
-				u := normal.Cross(reverse).Normalize().Mult(geometry.Float(rand.NormFloat64() * 0.5))
-				v := u.Cross(normal).Normalize().Mult(geometry.Float(rand.NormFloat64() * 0.5))
-				bounce := geometry.Vec3{
-					u.X + outgoing.X + v.X,
-					u.Y + outgoing.Y + v.Y,
-					u.Z + outgoing.Z + v.Z,
+				survival := float64(math.Max(float64(shape.Colour.X), math.Max(float64(shape.Colour.Y), float64(shape.Colour.Z))))
+				if rand.Float64() >= survival {
+					return
 				}
-				bounceRay := geometry.Ray{impact, bounce.Normalize()}
-				bleedColour := colour.MultVec(shape.Colour).Mult(alpha / (1 + distance))
-				DiffusePhoton(scene, shape, bounceRay, bleedColour, result, alpha*0.66, depth+1, rand)
+				bounce, _ := SampleCosineHemisphere(outgoing, rand)
+				bounceRay := geometry.Ray{impact, bounce}
+				bleedPower := power.MultVec(shape.Colour).Mult(geometry.Float(1 / survival))
+				DiffusePhoton(scene, shape, bounceRay, bleedPower, result, depth+1, rand)
+			} else {
+				nextRay := specularBounce(ray, shape, impact, normal, outgoing, rand)
+				DiffusePhoton(scene, shape, nextRay, power, result, depth+1, rand)
 			}
-			// Store Shadow Photons
-			shadowRay := geometry.Ray{impact, ray.Direction}
-			DiffusePhoton(scene, shape, shadowRay, geometry.Vec3{0, 0, 0}, result, alpha*0.66, depth+1, rand)
 		}
 	}
 }
 
-func PhotonChunk(scene []*geometry.Shape, traceFunc RayFunc, shape *geometry.Shape, factor, start, chunksize int, result chan<- PhotonHit, done chan<- bool, rand *rand.Rand) {
+// Emits photons uniformly in all directions from the center of shape.
+// Every photon carries the given power.
+func PhotonChunk(scene []*geometry.Shape, traceFunc RayFunc, shape *geometry.Shape, power geometry.Vec3, factor, start, chunksize int, result chan<- PhotonHit, done chan<- bool, rand *rand.Rand) {
 	for i := 0; i < chunksize; i++ {
 		longitude := (start*chunksize + i) / factor
 		latitude := (start*chunksize + i) % factor
 
-		//fmt.Println("Lo La:", longitude, latitude)
+		// Stratified over the sphere, equal steps in y give equal areas
+		phi := math.Pi * (float64(longitude) + rand.Float64()) / float64(factor)
+		y := 1 - 2*(float64(latitude)+rand.Float64())/float64(factor)
+		r := math.Sqrt(math.Max(0, 1-y*y))
 
-		sign := -2.0*float64(longitude%2.0) + 1.0
-		phi := 2.0 * math.Pi * float64(longitude) / float64(factor)
-		theta := math.Pi * float64(latitude) / float64(factor)
+		direction := geometry.Vec3{geometry.Float(r * math.Cos(phi)), geometry.Float(y), geometry.Float(r * math.Sin(phi))}
+		ray := geometry.Ray{shape.Position, direction.Normalize()}
+		traceFunc(scene, shape, ray, power, result, 0, rand)
+	}
+	done <- true
+}
 
-		//fmt.Println("S, T, P:", sign, theta, phi)
+// Emits photons from the sun. They start on a disk facing the sun just
+// outside of the scene bounds and all travel in the same direction.
+func SunChunk(scene *geometry.Scene, traceFunc RayFunc, power geometry.Vec3, factor, start, chunksize int, result chan<- PhotonHit, done chan<- bool, rand *rand.Rand) {
+	sky := scene.Sky
+	center, radius := scene.Bounds()
+	u, v := sky.Sun.Basis()
+	direction := sky.Sun.Mult(-1)
+	for i := 0; i < chunksize; i++ {
+		longitude := (start*chunksize + i) / factor
+		latitude := (start*chunksize + i) % factor
 
-		x, y, z := math.Sin(theta)*math.Cos(phi),
-			sign*math.Cos(theta),
-			math.Sin(theta)*math.Sin(phi)
+		phi := math.Pi * float64(longitude) / float64(factor)
+		r := float64(radius) * math.Sqrt((float64(latitude)+0.5)/float64(factor))
 
-		direction := geometry.Vec3{geometry.Float(x), geometry.Float(y), geometry.Float(z)}
-		ray := geometry.Ray{shape.Position, direction.Normalize()}
-		traceFunc(scene, shape, ray, shape.Emission, result, 1.0, 0, rand)
+		origin := center.Add(sky.Sun.Mult(2 * radius)).
+			Add(u.Mult(geometry.Float(r * math.Cos(phi)))).
+			Add(v.Mult(geometry.Float(r * math.Sin(phi))))
+		traceFunc(scene.Objects, nil, geometry.Ray{origin, direction}, power, result, 0, rand)
 	}
 	done <- true
 }
 
-func PhotonMapping(scene []*geometry.Shape, factor int, rayFunc RayFunc) ([]geometry.Vec3, []PhotonHit) {
+// Emits photons from the sky dome. They come from all directions, stratified
+// over the sphere like PhotonChunk, and start on a disk facing the direction
+// they come from just outside of the scene bounds. Every photon carries the
+// radiance of the sky in its direction times scale.
+func SkyChunk(scene *geometry.Scene, traceFunc RayFunc, scale geometry.Float, factor, start, chunksize int, result chan<- PhotonHit, done chan<- bool, rand *rand.Rand) {
+	sky := scene.Sky
+	center, radius := scene.Bounds()
+	for i := 0; i < chunksize; i++ {
+		longitude := (start*chunksize + i) / factor
+		latitude := (start*chunksize + i) % factor
+
+		phi := math.Pi * (float64(longitude) + rand.Float64()) / float64(factor)
+		y := 1 - 2*(float64(latitude)+rand.Float64())/float64(factor)
+		r := math.Sqrt(math.Max(0, 1-y*y))
+		towards := geometry.Vec3{geometry.Float(r * math.Cos(phi)), geometry.Float(y), geometry.Float(r * math.Sin(phi))}.Normalize()
+
+		u, v := towards.Basis()
+		diskR := float64(radius) * math.Sqrt(rand.Float64())
+		diskPhi := 2 * math.Pi * rand.Float64()
+		origin := center.Add(towards.Mult(2 * radius)).
+			Add(u.Mult(geometry.Float(diskR * math.Cos(diskPhi)))).
+			Add(v.Mult(geometry.Float(diskR * math.Sin(diskPhi))))
+		// Planes reach past the disk, only photons that see the sky from
+		// where they start carry its light
+		if shape, _ := ClosestIntersection(scene.Objects, geometry.Ray{origin, towards}); shape != nil {
+			continue
+		}
+		power := sky.Radiance(towards).Mult(scale)
+		traceFunc(scene.Objects, nil, geometry.Ray{origin, towards.Mult(-1)}, power, result, 0, rand)
+	}
+	done <- true
+}
+
+// Receives photons from chunks goroutines until they all reported done,
+// printing progress along the way. All photons came from light.
+func collectPhotons(hits chan PhotonHit, done chan bool, chunks, photons int, light *geometry.Shape) []PhotonHit {
+	go func() {
+		for start := 0; start < chunks; start++ {
+			<-done
+		}
+		close(hits)
+	}()
+
+	var result []PhotonHit
+	count := 0
+	const tick = 10000
+	fmt.Printf("Tracing %v photons through the scene ", photons)
+	for photon := range hits {
+		photon.Light = light
+		result = append(result, photon)
+		count++
+		if count%tick == 0 {
+			fmt.Printf(".")
+			if count%(10*tick) == 0 {
+				clearLine()
+				fmt.Printf("Tracing %v photons through the scene ", photons)
+			}
+		}
+	}
+	fmt.Printf("\rTraced %v photons to %v intersections in the scene.          \n", photons, count)
+	return result
+}
+
+func PhotonMapping(scene *geometry.Scene, factor int, rayFunc RayFunc) ([]geometry.Vec3, []PhotonHit) {
 	var (
 		points []geometry.Vec3
 		result []PhotonHit
@@ -201,56 +217,238 @@ func PhotonMapping(scene []*geometry.Shape, factor int, rayFunc RayFunc) ([]geom
 	photons := factor * factor * 2
 	chunks := 8
 	chunksize := photons / chunks
+	emitted := geometry.Float(chunks * chunksize)
 
-	for _, shape := range scene {
+	collect := func(hits chan PhotonHit, done chan bool, light *geometry.Shape) {
+		for _, photon := range collectPhotons(hits, done, chunks, photons, light) {
+			points = append(points, photon.Position())
+			result = append(result, photon)
+		}
+	}
+
+	for _, shape := range scene.Objects {
 		hits := make(chan PhotonHit)
 		done := make(chan bool)
-		if !shape.Emission.IsZero() {
+		if area := shape.Area(); !shape.Emission.IsZero() && !math.IsInf(float64(area), 0) {
+			// Lambertian emitters send out pi times their radiance per area
+			power := shape.Emission.Mult(math.Pi * area / emitted)
 			for start := 0; start < chunks; start++ {
-				go PhotonChunk(scene, rayFunc, shape, factor, start, chunksize, hits, done, rand.New(rand.NewSource(rand.Int63())))
+				go PhotonChunk(scene.Objects, rayFunc, shape, power, factor, start, chunksize, hits, done, rand.New(rand.NewSource(rand.Int63())))
+			}
+			collect(hits, done, shape)
+		}
+	}
+
+	if scene.Sky != nil && !scene.Sky.SunIrradiance.IsZero() {
+		hits := make(chan PhotonHit)
+		done := make(chan bool)
+		_, radius := scene.Bounds()
+		power := scene.Sky.SunIrradiance.Mult(math.Pi * radius * radius / emitted)
+		for start := 0; start < chunks; start++ {
+			go SunChunk(scene, rayFunc, power, factor, start, chunksize, hits, done, rand.New(rand.NewSource(rand.Int63())))
+		}
+		collect(hits, done, nil)
+	}
+
+	if scene.Sky != nil {
+		hits := make(chan PhotonHit)
+		done := make(chan bool)
+		// Radiance over the 4 pi steradians of the directions and the area
+		// of the disk they cross
+		_, radius := scene.Bounds()
+		scale := 4 * math.Pi * math.Pi * radius * radius / emitted
+		for start := 0; start < chunks; start++ {
+			go SkyChunk(scene, rayFunc, scale, factor, start, chunksize, hits, done, rand.New(rand.NewSource(rand.Int63())))
+		}
+		collect(hits, done, nil)
+	}
+	return points, result
+}
+
+////////////////////
+// Caustics
+////////////////////
+
+// Returns the shapes that can focus light, caustic photons are only sent
+// towards them.
+func causticTargets(scene *geometry.Scene) []*geometry.Shape {
+	var targets []*geometry.Shape
+	for _, shape := range scene.Objects {
+		_, radius := shape.BoundingSphere()
+		if shape.Material != geometry.DIFFUSE && !math.IsInf(float64(radius), 0) {
+			targets = append(targets, shape)
+		}
+	}
+	return targets
+}
+
+// Emits count photons from the center of emitter into the cone enclosing
+// targets[target]. Directions that fall into the cone of an earlier
+// target are skipped, that target's own chunk covers them.
+func CausticChunk(scene *geometry.Scene, emitter *geometry.Shape, targets []*geometry.Shape, target int, power geometry.Vec3, count int, result chan<- PhotonHit, done chan<- bool, rand *rand.Rand) {
+	axis, cosMax, _ := emitterCone(emitter.Position, targets[target])
+	for i := 0; i < count; i++ {
+		direction := SampleCone(axis, geometry.Float(cosMax), rand)
+		if inEarlierCone(emitter.Position, direction, targets[:target]) {
+			continue
+		}
+		CausticPhoton(scene.Objects, emitter, geometry.Ray{emitter.Position, direction}, power, result, 0, rand)
+	}
+	done <- true
+}
+
+func inEarlierCone(origin, direction geometry.Vec3, targets []*geometry.Shape) bool {
+	for _, target := range targets {
+		if axis, cosMax, ok := emitterCone(origin, target); ok && float64(direction.Dot(axis)) >= cosMax {
+			return true
+		}
+	}
+	return false
+}
+
+// Like CausticChunk for the sun. Photons start on the disk that the
+// bounding sphere of the target casts towards the sun.
+func SunCausticChunk(scene *geometry.Scene, targets []*geometry.Shape, target int, power geometry.Vec3, count int, result chan<- PhotonHit, done chan<- bool, rand *rand.Rand) {
+	sky := scene.Sky
+	sceneCenter, sceneRadius := scene.Bounds()
+	u, v := sky.Sun.Basis()
+	direction := sky.Sun.Mult(-1)
+	center, radius := targets[target].BoundingSphere()
+
+	for i := 0; i < count; i++ {
+		r := float64(radius) * math.Sqrt(rand.Float64())
+		phi := 2 * math.Pi * rand.Float64()
+		offset := u.Mult(geometry.Float(r * math.Cos(phi))).Add(v.Mult(geometry.Float(r * math.Sin(phi))))
+
+		skip := false
+		for _, earlier := range targets[:target] {
+			earlierCenter, earlierRadius := earlier.BoundingSphere()
+			// Distance from the earlier center perpendicular to the sun
+			difference := center.Add(offset).Sub(earlierCenter)
+			along := difference.Dot(sky.Sun)
+			if difference.Sub(sky.Sun.Mult(along)).Abs() <= earlierRadius {
+				skip = true
+				break
 			}
+		}
+		if skip {
+			continue
+		}
+
+		// Start outside of the scene so nothing is skipped on the way in
+		height := sceneCenter.Sub(center).Dot(sky.Sun) + 2*sceneRadius
+		origin := center.Add(offset).Add(sky.Sun.Mult(height))
+		CausticPhoton(scene.Objects, nil, geometry.Ray{origin, direction}, power, result, 0, rand)
+	}
+	done <- true
+}
 
-			go func() {
-				for start := 0; start < chunks; start++ {
-					<-done
+// Sends Config.Caustics photons from every emitter towards the specular and
+// refractive shapes of the scene and returns those that were focused onto
+// diffuse surfaces.
+func CausticMapping(scene *geometry.Scene) []PhotonHit {
+	var result []PhotonHit
+	targets := causticTargets(scene)
+	if len(targets) == 0 {
+		return nil
+	}
+	// Every target gets a share of the photons, but at least one
+	count := Config.Caustics / len(targets)
+	if count < 1 {
+		count = 1
+	}
+	chunks := len(targets)
+
+	for _, shape := range scene.Objects {
+		if area := shape.Area(); !shape.Emission.IsZero() && !math.IsInf(float64(area), 0) {
+			hits := make(chan PhotonHit)
+			done := make(chan bool)
+			for target := range targets {
+				// Each chunk gets the emitter's power that falls into its cone
+				power := geometry.Vec3{}
+				if _, cosMax, ok := emitterCone(shape.Position, targets[target]); ok && targets[target] != shape {
+					solidAngle := 2 * math.Pi * (1 - cosMax)
+					power = shape.Emission.Mult(geometry.Float(math.Pi * float64(area) * solidAngle / (4 * math.Pi * float64(count))))
 				}
-				close(hits)
-			}()
-
-			count := 0
-			const tick = 10000
-			fmt.Printf("Tracing %v photons through the scene ", photons)
-			for photon := range hits {
-				points = append(points, photon.Position())
-				result = append(result, photon)
-				count++
-				if count%tick == 0 {
-					fmt.Printf(".")
-					if count%(10*tick) == 0 {
-						clearLine()
-						fmt.Printf("Tracing %v photons through the scene ", photons)
-					}
+				if power.IsZero() {
+					go func() { done <- true }()
+					continue
 				}
+				go CausticChunk(scene, shape, targets, target, power, count, hits, done, rand.New(rand.NewSource(rand.Int63())))
 			}
-			fmt.Printf("\rTraced %v photons to %v intersections in the scene.          \n", photons, count)
+			result = append(result, collectPhotons(hits, done, chunks, count*chunks, shape)...)
 		}
 	}
-	return points, result
+
+	if scene.Sky != nil && !scene.Sky.SunIrradiance.IsZero() {
+		hits := make(chan PhotonHit)
+		done := make(chan bool)
+		for target := range targets {
+			_, radius := targets[target].BoundingSphere()
+			power := scene.Sky.SunIrradiance.Mult(math.Pi * radius * radius / geometry.Float(count))
+			go SunCausticChunk(scene, targets, target, power, count, hits, done, rand.New(rand.NewSource(rand.Int63())))
+		}
+		result = append(result, collectPhotons(hits, done, chunks, count*chunks, nil)...)
+	}
+	return result
 }
 
-//var causticPhotons map[geometry.Vec3]PhotonHit
+// Estimates the radiance leaving a diffuse surface with the given albedo
+// from the k photons nearest to point, searching no further than radius.
+// Only photons arriving from the side of the surface that normal points to
+// are counted.
+func PhotonRadiance(photonMap *kd.KDNode, point, normal, albedo geometry.Vec3, k int, radius geometry.Float) geometry.Vec3 {
+	return photonRadiance(photonMap, point, normal, albedo, k, radius, nil)
+}
 
-func GenerateMaps(scene []*geometry.Shape) *kd.KDNode /*, *kd.KDNode*/ {
-	//caustics, caustics_ := PhotonMapping(scene, Config.Caustics, CausticPhoton)
-	globals, _ := PhotonMapping(scene, 16, DiffusePhoton)
-	fmt.Printf("Building KD-trees ...")
+// Like PhotonRadiance, also calling found with the radiance contributed by
+// every photon if it isn't nil
+func photonRadiance(photonMap *kd.KDNode, point, normal, albedo geometry.Vec3, k int, radius geometry.Float, found func(PhotonHit, geometry.Vec3)) geometry.Vec3 {
+	nodes, radius2 := photonMap.Nearest(point, k, radius)
+	// Photons exactly on the point cover no area to spread them over
+	if len(nodes) == 0 || radius2 == 0 {
+		return geometry.Vec3{0, 0, 0}
+	}
+
+	// Lambertian reflectance over the area of the gather disk
+	scale := albedo.Mult(1 / (math.Pi * math.Pi * radius2))
+	var flux geometry.Vec3
+	for _, node := range nodes {
+		photon := node.Item.(PhotonHit)
+		if photon.Incomming.Dot(normal) < 0 {
+			flux.AddInPlace(photon.Photon)
+			if found != nil {
+				found(photon, photon.Photon.MultVec(scale))
+			}
+		}
+	}
+	return flux.MultVec(scale)
+}
+
+func buildMap(photons []PhotonHit) <-chan *kd.KDNode {
+	items := make([]kd.Item, len(photons))
+	for i := range photons {
+		items[i] = photons[i]
+	}
+	return kd.AsyncNewItems(items, 3)
+}
 
-	//causticPhotons = make(map[geometry.Vec3]PhotonHit)
-	//for i := range caustics {
-	//	causticPhotons[caustics[i]] = caustics_[i]
-	//}
+// Traces Config.Photons photons from every emitter and the sky and stores
+// where they land on diffuse surfaces, and Config.Caustics photons that are
+// focused by specular and refractive shapes. Either map is nil if it is
+// disabled.
+func GenerateMaps(scene *geometry.Scene) (*kd.KDNode, *kd.KDNode) {
+	var globals, caustics []PhotonHit
+	if Config.Photons > 0 && Config.PhotonGather > 0 {
+		factor := int(math.Sqrt(float64(Config.Photons) / 2))
+		_, globals = PhotonMapping(scene, factor, DiffusePhoton)
+	}
+	if Config.Caustics > 0 && Config.CausticGather > 0 {
+		caustics = CausticMapping(scene)
+	}
+	fmt.Printf("Building KD-trees ...")
 
-	globalsChannel := kd.AsyncNew(globals, 3)
-	//causticsChannel := kd.AsyncNew(caustics, 3)
-	return <-globalsChannel //, <-causticsChannel
+	globalsChannel := buildMap(globals)
+	causticsChannel := buildMap(caustics)
+	return <-globalsChannel, <-causticsChannel
 }
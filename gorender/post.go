@@ -0,0 +1,212 @@
+package gorender
+
+import (
+	"fmt"
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"sort"
+)
+
+////////////////////////
+// Post processing
+////////////////////////
+
+// A PostProcess changes the colours of a rendered image. Most work on the
+// linear colours after exposure, before the image is tone mapped, those in
+// DisplayReferred on the display encoded ones. It may change colours in
+// place.
+type PostProcess interface {
+	Process(colours [][]geometry.Vec3) [][]geometry.Vec3
+}
+
+// A PostProcess made from a function
+type PostProcessFunc func(colours [][]geometry.Vec3) [][]geometry.Vec3
+
+func (f PostProcessFunc) Process(colours [][]geometry.Vec3) [][]geometry.Vec3 {
+	return f(colours)
+}
+
+// Creates a post process from the settings in Config
+type PostProcessFactory func() (PostProcess, error)
+
+// The post processes selectable by name for Config.PostProcessing
+var PostProcesses = map[string]PostProcessFactory{
+	"bloom": func() (PostProcess, error) {
+		return PostProcessFunc(func(colours [][]geometry.Vec3) [][]geometry.Vec3 {
+			if Config.BloomFactor > 0 {
+				Bloom(colours, Config.BloomFactor, Config.BloomThreshold, Config.BloomIntensity)
+			}
+			return colours
+		}), nil
+	},
+	"vignette": func() (PostProcess, error) {
+		return PostProcessFunc(vignette), nil
+	},
+	"chromatic": func() (PostProcess, error) {
+		return PostProcessFunc(chromaticAberration), nil
+	},
+	"sharpen": func() (PostProcess, error) {
+		return PostProcessFunc(sharpen), nil
+	},
+	"grade": func() (PostProcess, error) {
+		return perPixel(grade), nil
+	},
+	"lut": func() (PostProcess, error) {
+		lut, err := LoadCube(Config.LUT)
+		if err != nil {
+			return nil, err
+		}
+		return perPixel(lut.Apply), nil
+	},
+}
+
+// The post processes that expect colours encoded for display, from 0 to 1,
+// like grading tools and .cube files do. They run after tone mapping and
+// the transfer function, so they must come after all other post processes.
+var DisplayReferred = map[string]bool{
+	"grade": true,
+	"lut":   true,
+}
+
+// Returns the names of all post processes in alphabetical order
+func PostProcessNames() []string {
+	var names []string
+	for name := range PostProcesses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Creates the post processes with the given names, to be run in order,
+// split into those run on linear colours and those run on display encoded
+// ones
+func NewPostProcessing(names []string) (linear, display []PostProcess, err error) {
+	for i, name := range names {
+		factory, ok := PostProcesses[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown post process %q", name)
+		}
+		if !DisplayReferred[name] && len(display) > 0 {
+			return nil, nil, fmt.Errorf("post process %v must come before %v, which works on display encoded colours", name, names[i-1])
+		}
+		process, err := factory()
+		if err != nil {
+			return nil, nil, fmt.Errorf("post process %v: %v", name, err)
+		}
+		if DisplayReferred[name] {
+			display = append(display, process)
+		} else {
+			linear = append(linear, process)
+		}
+	}
+	return linear, display, nil
+}
+
+// Returns a post process changing every pixel with f, in parallel
+func perPixel(f func(geometry.Vec3) geometry.Vec3) PostProcess {
+	return PostProcessFunc(func(colours [][]geometry.Vec3) [][]geometry.Vec3 {
+		parallel(len(colours), func(y int) {
+			for x, colour := range colours[y] {
+				colours[y][x] = f(colour)
+			}
+		})
+		return colours
+	})
+}
+
+// Darkens the image towards the corners by Config.Vignette
+func vignette(colours [][]geometry.Vec3) [][]geometry.Vec3 {
+	rows, cols := len(colours), len(colours[0])
+	centreX, centreY := float64(cols)/2, float64(rows)/2
+	corner2 := centreX*centreX + centreY*centreY
+	parallel(rows, func(y int) {
+		dy := float64(y) + 0.5 - centreY
+		for x := range colours[y] {
+			dx := float64(x) + 0.5 - centreX
+			factor := math.Max(0, 1-Config.Vignette*(dx*dx+dy*dy)/corner2)
+			colours[y][x] = colours[y][x].Mult(geometry.Float(factor))
+		}
+	})
+	return colours
+}
+
+// Separates the red and blue light towards the edges like a lens with
+// lateral chromatic aberration. Red is spread outwards and blue inwards by
+// Config.ChromaticAberration of the distance from the centre.
+func chromaticAberration(colours [][]geometry.Vec3) [][]geometry.Vec3 {
+	rows, cols := len(colours), len(colours[0])
+	centreX, centreY := float64(cols)/2, float64(rows)/2
+	shift := Config.ChromaticAberration
+	result := make([][]geometry.Vec3, rows)
+	parallel(rows, func(y int) {
+		result[y] = make([]geometry.Vec3, cols)
+		dy := float64(y) + 0.5 - centreY
+		for x, colour := range colours[y] {
+			dx := float64(x) + 0.5 - centreX
+			// Red seen here comes from closer to the centre
+			red := sampleBilinear(colours, centreX+dx/(1+shift), centreY+dy/(1+shift))
+			blue := sampleBilinear(colours, centreX+dx/(1-shift), centreY+dy/(1-shift))
+			result[y][x] = geometry.Vec3{red.X, colour.Y, blue.Z}
+		}
+	})
+	return result
+}
+
+// Interpolates the colour at position x, y measured from the top left
+// corner of the image, clamping to the edges
+func sampleBilinear(colours [][]geometry.Vec3, x, y float64) geometry.Vec3 {
+	rows, cols := len(colours), len(colours[0])
+	x, y = x-0.5, y-0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := geometry.Float(x-x0), geometry.Float(y-y0)
+	at := func(x, y int) geometry.Vec3 {
+		return colours[clampIndex(y, rows)][clampIndex(x, cols)]
+	}
+	top := at(int(x0), int(y0)).Mult(1 - fx).Add(at(int(x0)+1, int(y0)).Mult(fx))
+	bottom := at(int(x0), int(y0)+1).Mult(1 - fx).Add(at(int(x0)+1, int(y0)+1).Mult(fx))
+	return top.Mult(1 - fy).Add(bottom.Mult(fy))
+}
+
+// Sharpens the image with an unsharp mask: the difference to a 3x3
+// gaussian blur is added Config.Sharpen times
+func sharpen(colours [][]geometry.Vec3) [][]geometry.Vec3 {
+	rows, cols := len(colours), len(colours[0])
+	kernel := [3]geometry.Float{0.25, 0.5, 0.25}
+	amount := geometry.Float(Config.Sharpen)
+	result := make([][]geometry.Vec3, rows)
+	parallel(rows, func(y int) {
+		result[y] = make([]geometry.Vec3, cols)
+		for x, colour := range colours[y] {
+			var blurred geometry.Vec3
+			for j := -1; j <= 1; j++ {
+				for i := -1; i <= 1; i++ {
+					neighbour := colours[clampIndex(y+j, rows)][clampIndex(x+i, cols)]
+					blurred.AddInPlace(neighbour.Mult(kernel[i+1] * kernel[j+1]))
+				}
+			}
+			result[y][x] = colour.Add(colour.Sub(blurred).Mult(amount))
+		}
+	})
+	return result
+}
+
+// Grades a display encoded colour with Config.Lift, which raises the blacks,
+// Config.Gain, which scales the whites, and Config.Gamma, which bends the
+// midtones, per channel. Config.Saturation scales the distance of the
+// result from grey.
+func grade(colour geometry.Vec3) geometry.Vec3 {
+	channel := func(x, lift, gamma, gain geometry.Float) geometry.Float {
+		x = gain*x + lift*(1-x)
+		return geometry.Float(math.Pow(math.Max(0, float64(x)), 1/float64(gamma)))
+	}
+	lift, gamma, gain := Config.Lift, Config.Gamma, Config.Gain
+	graded := geometry.Vec3{
+		channel(colour.X, lift.X, gamma.X, gain.X),
+		channel(colour.Y, lift.Y, gamma.Y, gain.Y),
+		channel(colour.Z, lift.Z, gamma.Z, gain.Z),
+	}
+	grey := geometry.Float(luminance(graded))
+	grey3 := geometry.Vec3{grey, grey, grey}
+	return grey3.Add(graded.Sub(grey3).Mult(geometry.Float(Config.Saturation)))
+}
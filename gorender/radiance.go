@@ -8,87 +8,189 @@ import (
 	"math/rand"
 )
 
-func EmitterSampling(point, normal geometry.Vec3, shapes []*geometry.Shape, rand *rand.Rand) geometry.Vec3 {
-	incomingLight := geometry.Vec3{0, 0, 0}
+// Returns the cosine of the half angle of the cone of directions from
+// point that enclose the emitter. Points inside the bounding sphere of the
+// emitter can't sample it, in which case ok is false.
+func emitterCone(point geometry.Vec3, emitter *geometry.Shape) (axis geometry.Vec3, cosMax float64, ok bool) {
+	center, radius := emitter.BoundingSphere()
+	distance2 := float64(center.Distance2(point))
+	radius2 := float64(radius * radius)
+	if math.IsInf(radius2, 0) || distance2 <= radius2*1.001 {
+		return axis, 0, false
+	}
+	return center.Sub(point).Normalize(), math.Sqrt(1 - radius2/distance2), true
+}
+
+// The probability density of EmitterSampling choosing direction
+// from point towards emitter, which is nil for the sun.
+func emitterPdf(point geometry.Vec3, emitter *geometry.Shape, scene *geometry.Scene, lights *LightSampler) float64 {
+	choice := lights.Pdf(emitter) * float64(Config.LightSamples)
+	if emitter == nil {
+		return choice * ConePdf(float64(scene.Sky.SunCosAngle))
+	}
+	if _, cosMax, ok := emitterCone(point, emitter); ok {
+		return choice * ConePdf(cosMax)
+	}
+	return 0
+}
 
-	for _, shape := range shapes {
-		if !shape.Emission.IsZero() {
-			// It's a light source
-			direction := shape.NormalDir(point).Mult(-1)
-			u := direction.Cross(normal).Normalize().Mult(geometry.Float(rand.NormFloat64() * 0.3))
-			v := direction.Cross(u).Normalize().Mult(geometry.Float(rand.NormFloat64() * 0.3))
+// The radiance of the sun disk as seen along direction, or zero when the
+// direction misses it.
+func sunRadiance(sky *geometry.Sky, direction geometry.Vec3) geometry.Vec3 {
+	if sky == nil || direction.Dot(sky.Sun) < sky.SunCosAngle {
+		return geometry.Vec3{0, 0, 0}
+	}
+	return sky.SunIrradiance.Mult(geometry.Float(ConePdf(float64(sky.SunCosAngle))))
+}
 
-			direction.X += u.X + v.X
-			direction.Y += u.Y + v.Y
-			direction.Z += u.Z + v.Z
-			ray := geometry.Ray{point, direction.Normalize()}
+// Estimates the light arriving directly from emitters at a diffuse point
+// with the given normal, divided by pi so it only has to be multiplied by
+// the albedo of the surface. Config.LightSamples lights are chosen by
+// their power and weighted against the chance of the diffuse bounce
+// finding them.
+func EmitterSampling(point, normal geometry.Vec3, self *geometry.Shape, scene *geometry.Scene, lights *LightSampler, rand *rand.Rand) geometry.Vec3 {
+	return emitterSampling(point, normal, self, scene, lights, rand, nil)
+}
 
-			if object, distance := ClosestIntersection(shapes, ray); object == shape {
-				incomingLight.AddInPlace(object.Emission.Mult(direction.Dot(normal) / (1 + distance)))
+// Like EmitterSampling, also calling found with the light of every sample
+// if it isn't nil
+func emitterSampling(point, normal geometry.Vec3, self *geometry.Shape, scene *geometry.Scene, lights *LightSampler, rand *rand.Rand, found func(*Light, geometry.Vec3)) geometry.Vec3 {
+	incomingLight := geometry.Vec3{0, 0, 0}
+	samples := Config.LightSamples
+
+	for i := 0; i < samples; i++ {
+		light, choice := lights.Sample(rand)
+		if light == nil || light.Shape == self {
+			continue
+		}
+
+		var axis geometry.Vec3
+		var cosMax float64
+		if light.Shape == nil {
+			// The sun is a directional light just outside of the scene
+			axis, cosMax = scene.Sky.Sun, float64(scene.Sky.SunCosAngle)
+		} else {
+			var ok bool
+			if axis, cosMax, ok = emitterCone(point, light.Shape); !ok {
+				continue
 			}
 		}
+
+		direction := SampleCone(axis, geometry.Float(cosMax), rand)
+		cos := float64(direction.Dot(normal))
+		if cos <= 0 {
+			continue
+		}
+
+		var emission geometry.Vec3
+		object, _ := ClosestIntersection(scene.Objects, geometry.Ray{point, direction})
+		if light.Shape == nil && object == nil {
+			emission = sunRadiance(scene.Sky, direction)
+		} else if light.Shape != nil && object == light.Shape {
+			emission = object.Emission
+		} else {
+			continue
+		}
+
+		lightPdf := choice * float64(samples) * ConePdf(cosMax)
+		weight := PowerHeuristic(lightPdf, cos/math.Pi)
+		sample := emission.Mult(geometry.Float(cos * weight / (lightPdf * math.Pi)))
+		incomingLight.AddInPlace(sample)
+		if found != nil {
+			found(light, sample)
+		}
 	}
 	return incomingLight
 }
 
-func Radiance(ray geometry.Ray, scene *geometry.Scene, diffuseMap /*, causticsMap*/ *kd.KDNode, depth int, alpha float64, rand *rand.Rand) geometry.Vec3 {
+func Radiance(ray geometry.Ray, scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler, depth int, throughput geometry.Vec3, rand *rand.Rand) geometry.Vec3 {
+	return radiance(ray, scene, diffuseMap, causticsMap, lights, depth, throughput, rand, 0, false, lightPath{})
+}
 
-	if depth > Config.MinDepth && rand.Float64() > alpha {
+// Ends paths at Config.MaxDepth and, past Config.MinDepth, by Russian
+// roulette. throughput is the fraction of the light found along ray that
+// reaches the camera; the darker the path has become, the more likely it
+// is ended. Surviving paths are scaled up by their survival probability so
+// the estimate stays unbiased.
+func radiance(ray geometry.Ray, scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler, depth int, throughput geometry.Vec3, rand *rand.Rand, bouncePdf float64, gathered bool, path lightPath) geometry.Vec3 {
+	if depth > Config.MaxDepth {
 		return geometry.Vec3{0, 0, 0}
 	}
 
+	survival := 1.0
+	if depth > Config.MinDepth {
+		survival = math.Min(1, maxComponent(throughput))
+		if rand.Float64() >= survival {
+			return geometry.Vec3{0, 0, 0}
+		}
+		throughput = throughput.Mult(geometry.Float(1 / survival))
+	}
+
+	return shade(ray, scene, diffuseMap, causticsMap, lights, depth, throughput, rand, bouncePdf, gathered, path).Mult(geometry.Float(1 / survival))
+}
+
+// Traces ray through the scene. bouncePdf is the density with which a
+// diffuse bounce chose the direction of ray, so that emitters it hits can
+// be weighted against EmitterSampling. It is zero for camera rays and
+// specular paths, which see emitters at full strength. Once the path has
+// bounced off a diffuse surface, gathered is set and the next diffuse
+// surface is shaded from the photon map if there is one. Diffuse surfaces
+// that are shaded explicitly take focused light from the caustics map.
+// Everything found is recorded into the passes of path.
+func shade(ray geometry.Ray, scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, lights *LightSampler, depth int, throughput geometry.Vec3, rand *rand.Rand, bouncePdf float64, gathered bool, path lightPath) geometry.Vec3 {
 	if shape, distance := ClosestIntersection(scene.Objects, ray); shape != nil {
 		impact := ray.Origin.Add(ray.Direction.Mult(distance))
 		normal := shape.NormalDir(impact).Normalize()
 		reverse := ray.Direction.Mult(-1)
 
-		contribution := shape.Emission
+		// Light reaching the last diffuse surface through mirrors and glass
+		// is already in the caustics map
+		causticPath := gathered && bouncePdf == 0 && causticsMap != nil
+
+		var contribution geometry.Vec3
+		if !causticPath {
+			contribution = emittedRadiance(ray, shape, scene, lights, bouncePdf)
+			path.emitted(shape, contribution, throughput)
+		}
 		outgoing := normal
 		if normal.Dot(reverse) < 0 {
 			outgoing = normal.Mult(-1)
 		}
 
 		if shape.Material == geometry.DIFFUSE {
-			var /*causticLight,*/ directLight geometry.Vec3
-
-			/*nodes := causticsMap.Neighbors(impact, 0.1)
-			for _, e := range nodes {
-				photon := causticPhotons[e.Position]
-				dist := photon.Location.Distance(impact)
-				light := photon.Photon.Mult(outgoing.Dot(photon.Incomming.Mult(-1 / math.Pi * (1 + dist))))
-				causticLight.AddInPlace(light)
+			if gathered && diffuseMap != nil {
+				// The photon map already holds all light arriving here
+				gatheredLight := photonRadiance(diffuseMap, impact, outgoing, shape.Colour, Config.PhotonGather, geometry.Float(Config.GatherRadius), path.photons(throughput))
+				path.scattered(gatheredLight, throughput, false)
+				return contribution.Add(gatheredLight)
 			}
-			if len(nodes) > 0 {
-				causticLight = causticLight.Mult(1.0 / float64(len(nodes)))
-			}*/
 
-			directLight = EmitterSampling(impact, normal, scene.Objects, rand)
+			var causticLight, directLight geometry.Vec3
 
-			u := normal.Cross(reverse).Normalize().Mult(geometry.Float(rand.NormFloat64() * 0.5))
-			v := u.Cross(normal).Normalize().Mult(geometry.Float(rand.NormFloat64() * 0.5))
-
-			bounceDirection := geometry.Vec3{
-				u.X + outgoing.X + v.X,
-				u.Y + outgoing.Y + v.Y,
-				u.Z + outgoing.Z + v.Z,
-			}
-			bounceRay := geometry.Ray{impact, bounceDirection.Normalize()}
-			indirectLight := Radiance(bounceRay, scene, diffuseMap /*causticsMap,*/, depth+1, alpha*0.9, rand)
-			dot := outgoing.Dot(reverse)
-			diffuseLight := geometry.Vec3{
-				(shape.Colour.X * (directLight.X + indirectLight.X) /*+ causticLight.X*/) * dot,
-				(shape.Colour.Y * (directLight.Y + indirectLight.Y) /*+ causticLight.Y*/) * dot,
-				(shape.Colour.Z * (directLight.Z + indirectLight.Z) /*+ causticLight.Z*/) * dot,
+			if causticsMap != nil {
+				causticLight = photonRadiance(causticsMap, impact, outgoing, shape.Colour, Config.CausticGather, geometry.Float(Config.CausticRadius), path.photons(throughput))
+				path.scattered(causticLight, throughput, false)
 			}
 
+			directLight = emitterSampling(impact, outgoing, shape, scene, lights, rand, path.lightSamples(shape.Colour, throughput))
+			path.scattered(shape.Colour.MultVec(directLight), throughput, true)
+
+			// Cosine weighted bounce, the cosine and pi of the lambertian
+			// reflectance cancel against its density
+			bounceDirection, pdf := SampleCosineHemisphere(outgoing, rand)
+			bounceRay := geometry.Ray{impact, bounceDirection}
+			indirectLight := radiance(bounceRay, scene, diffuseMap, causticsMap, lights, depth+1, throughput.MultVec(shape.Colour), rand, pdf, true, path.bounce(geometry.DIFFUSE, false))
+			diffuseLight := shape.Colour.MultVec(directLight.Add(indirectLight)).Add(causticLight)
+
 			return contribution.Add(diffuseLight)
 
 		}
 		if shape.Material == geometry.SPECULAR {
 			reflectionDirection := ray.Direction.Sub(normal.Mult(2 * outgoing.Dot(ray.Direction)))
 			reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-			incomingLight := Radiance(reflectedRay, scene, diffuseMap /*causticsMap,*/, depth+1, alpha*0.99, rand)
-			return incomingLight.Mult(outgoing.Dot(reverse))
+			cos := outgoing.Dot(reverse)
+			incomingLight := radiance(reflectedRay, scene, diffuseMap, causticsMap, lights, depth+1, throughput.Mult(cos), rand, 0, gathered, path.bounce(geometry.SPECULAR, false))
+			return incomingLight.Mult(cos)
 		}
 
 		if shape.Material == geometry.REFRACTIVE {
@@ -145,11 +247,12 @@ func Radiance(ray geometry.Ray, scene *geometry.Scene, diffuseMap /*, causticsMa
 			if totalReflection {
 				reflectionDirection := ray.Direction.Sub(outgoing.Mult(2 * outgoing.Dot(ray.Direction)))
 				reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-				return Radiance(reflectedRay, scene, diffuseMap /*causticsMap,*/, depth+1, alpha*0.9, rand)
+				return radiance(reflectedRay, scene, diffuseMap, causticsMap, lights, depth+1, throughput, rand, 0, gathered, path.bounce(geometry.REFRACTIVE, false))
 			} else {
+				cos := outgoing.Dot(reverse)
 				reflectionDirection := ray.Direction.Sub(outgoing.Mult(2 * outgoing.Dot(ray.Direction)))
 				reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-				reflectedLight := Radiance(reflectedRay, scene, diffuseMap /*causticsMap,*/, depth+1, alpha*0.9, rand).Mult(geometry.Float(R))
+				reflectedLight := radiance(reflectedRay, scene, diffuseMap, causticsMap, lights, depth+1, throughput.Mult(geometry.Float(R)*cos), rand, 0, gathered, path.bounce(geometry.REFRACTIVE, false)).Mult(geometry.Float(R))
 
 				nDotI := float64(normal.Dot(ray.Direction))
 				trasmittedDirection := ray.Direction.Mult(geometry.Float(factor))
@@ -158,12 +261,87 @@ func Radiance(ray geometry.Ray, scene *geometry.Scene, diffuseMap /*, causticsMa
 
 				trasmittedDirection = trasmittedDirection.Add(normal.Mult(geometry.Float(term2 - term3)))
 				transmittedRay := geometry.Ray{impact, trasmittedDirection.Normalize()}
-				transmittedLight := Radiance(transmittedRay, scene, diffuseMap /*causticsMap,*/, depth+1, alpha*0.9, rand).Mult(geometry.Float(T))
-				return reflectedLight.Add(transmittedLight).Mult(outgoing.Dot(reverse))
+				transmittedLight := radiance(transmittedRay, scene, diffuseMap, causticsMap, lights, depth+1, throughput.Mult(geometry.Float(T)*cos), rand, 0, gathered, path.bounce(geometry.REFRACTIVE, true)).Mult(geometry.Float(T))
+				return reflectedLight.Add(transmittedLight).Mult(cos)
 			}
 		}
 		panic("Material without property encountered!")
 	}
 
+	if gathered && bouncePdf == 0 && causticsMap != nil && scene.Sky != nil {
+		// The sun seen through mirrors and glass is in the caustics map
+		skyLight := scene.Sky.Radiance(ray.Direction)
+		path.emitted(nil, skyLight, throughput)
+		return skyLight
+	}
+	missLight := missRadiance(ray, scene, lights, bouncePdf)
+	path.emitted(nil, missLight, throughput)
+	return missLight
+}
+
+func maxComponent(v geometry.Vec3) float64 {
+	return math.Max(math.Max(float64(v.X), float64(v.Y)), float64(v.Z))
+}
+
+// The emission of shape as seen along ray, weighted against EmitterSampling
+// if a diffuse bounce with density bouncePdf chose the ray.
+func emittedRadiance(ray geometry.Ray, shape *geometry.Shape, scene *geometry.Scene, lights *LightSampler, bouncePdf float64) geometry.Vec3 {
+	emission := shape.Emission
+	if bouncePdf > 0 && !emission.IsZero() {
+		weight := PowerHeuristic(bouncePdf, emitterPdf(ray.Origin, shape, scene, lights))
+		emission = emission.Mult(geometry.Float(weight))
+	}
+	return emission
+}
+
+// The light arriving along a ray that leaves the scene.
+func missRadiance(ray geometry.Ray, scene *geometry.Scene, lights *LightSampler, bouncePdf float64) geometry.Vec3 {
+	if sky := scene.Sky; sky != nil {
+		// Rays leaving the scene see the sky and possibly the sun
+		sun := sunRadiance(sky, ray.Direction)
+		if bouncePdf > 0 && !sun.IsZero() {
+			weight := PowerHeuristic(bouncePdf, emitterPdf(ray.Origin, nil, scene, lights))
+			sun = sun.Mult(geometry.Float(weight))
+		}
+		return sky.Radiance(ray.Direction).Add(sun)
+	}
 	return geometry.Vec3{0, 0, 0}
 }
+
+// Chooses between reflection and refraction at a specular or refractive
+// surface by their Fresnel weights and returns the continued ray.
+func specularBounce(ray geometry.Ray, shape *geometry.Shape, impact, normal, outgoing geometry.Vec3, rand *rand.Rand) geometry.Ray {
+	reflectionDirection := ray.Direction.Sub(outgoing.Mult(2 * outgoing.Dot(ray.Direction)))
+	reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
+	if shape.Material != geometry.REFRACTIVE {
+		return reflectedRay
+	}
+
+	transmittedDirection, ok := refract(ray.Direction, normal, outgoing)
+	R := math.Pow((AIR-GLASS)/(AIR+GLASS), 2)
+	if !ok || rand.Float64() < R {
+		return reflectedRay
+	}
+	return geometry.Ray{impact, transmittedDirection}
+}
+
+// Returns the direction of light passing into or out of glass, or false if
+// it is totally reflected. outgoing is the normal facing the incoming
+// light.
+func refract(direction, normal, outgoing geometry.Vec3) (geometry.Vec3, bool) {
+	n1, n2 := AIR, GLASS
+	if normal.Dot(outgoing) < 0 {
+		// Leave the glass
+		n1, n2 = GLASS, AIR
+	}
+	factor := n1 / n2
+	cosTi := float64(outgoing.Dot(direction.Mult(-1)))
+	discriminant := 1 - factor*factor*(1-cosTi*cosTi)
+	if discriminant < 0 {
+		return geometry.Vec3{}, false
+	}
+
+	transmittedDirection := direction.Mult(geometry.Float(factor)).
+		Add(outgoing.Mult(geometry.Float(factor*cosTi - math.Sqrt(discriminant))))
+	return transmittedDirection.Normalize(), true
+}
@@ -0,0 +1,282 @@
+package gorender
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+////////////////////
+// Samplers
+////////////////////
+
+// A Sampler generates the random numbers of the samples of a pixel. It is
+// a rand.Source, so the integrators draw from it through the *rand.Rand
+// they already take: every call of Int63 returns the next dimension of the
+// current sample. The pixel position comes first, followed by the light
+// and bounce dimensions in the order the integrator draws them. Samplers
+// that spread the samples of a pixel evenly in every dimension converge
+// faster than independent random numbers.
+type Sampler interface {
+	rand.Source
+	StartPixel(x, y int)
+	StartSample(index int)
+}
+
+// Creates a sampler for pixels with the given number of samples
+type SamplerFactory func(samples int, seed int64) Sampler
+
+// The samplers selectable by name with Config.Sampler
+var Samplers = map[string]SamplerFactory{
+	"independent": func(samples int, seed int64) Sampler {
+		return &IndependentSampler{rand.New(rand.NewSource(seed))}
+	},
+	"stratified": func(samples int, seed int64) Sampler {
+		return &StratifiedSampler{samplerState: newSamplerState(seed), Strata: samples}
+	},
+	"halton": func(samples int, seed int64) Sampler {
+		return &HaltonSampler{newSamplerState(seed)}
+	},
+	"sobol": func(samples int, seed int64) Sampler {
+		return &SobolSampler{newSamplerState(seed)}
+	},
+}
+
+// Returns the names of all samplers in alphabetical order
+func SamplerNames() []string {
+	var names []string
+	for name := range Samplers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Turns a number in [0, 1) into the result of rand.Source.Int63, which
+// rand.Float64 turns back into the same number
+func toInt63(u float64) int64 {
+	return int64(u * (1 << 63))
+}
+
+// Mixes the bits of a and b into a well distributed hash
+func hash(a, b uint64) uint64 {
+	x := a ^ (b+0x9e3779b97f4a7c15)*0xbf58476d1ce4e5b9
+	x ^= x >> 31
+	x *= 0x94d049bb133111eb
+	x ^= x >> 29
+	x *= 0xbf58476d1ce4e5b9
+	return x ^ x>>32
+}
+
+// Independent uniform random numbers, as used before samplers existed
+type IndependentSampler struct {
+	rand *rand.Rand
+}
+
+func (s *IndependentSampler) StartPixel(x, y int)   {}
+func (s *IndependentSampler) StartSample(index int) {}
+func (s *IndependentSampler) Seed(seed int64)       { s.rand.Seed(seed) }
+func (s *IndependentSampler) Int63() int64          { return s.rand.Int63() }
+
+// The bookkeeping shared by the deterministic samplers: which pixel,
+// sample and dimension comes next, and a seed that differs per pixel so
+// neighbouring pixels don't share their patterns.
+type samplerState struct {
+	seed, pixel      uint64
+	index, dimension int
+	rand             *rand.Rand
+}
+
+func newSamplerState(seed int64) samplerState {
+	return samplerState{seed: uint64(seed), rand: rand.New(rand.NewSource(seed))}
+}
+
+func (s *samplerState) StartPixel(x, y int) {
+	s.pixel = hash(hash(s.seed, uint64(x)), uint64(y))
+}
+
+func (s *samplerState) StartSample(index int) {
+	s.index, s.dimension = index, 0
+}
+
+func (s *samplerState) Seed(seed int64) {
+	s.seed = uint64(seed)
+	s.rand.Seed(seed)
+}
+
+// Returns the dimension to generate next and a seed for it
+func (s *samplerState) next() (int, uint64) {
+	dimension := s.dimension
+	s.dimension++
+	return dimension, hash(s.pixel, uint64(dimension))
+}
+
+// StratifiedSampler splits every dimension into Strata intervals and puts
+// one jittered sample into each, in an order shuffled per pixel and
+// dimension so the dimensions don't correlate (Latin hypercube sampling).
+// With adaptive sampling, every further Strata samples are stratified
+// again.
+type StratifiedSampler struct {
+	samplerState
+	Strata int
+}
+
+func (s *StratifiedSampler) Int63() int64 {
+	_, seed := s.next()
+	strata := uint32(s.Strata)
+	if strata < 1 {
+		strata = 1
+	}
+	round := uint64(s.index / int(strata))
+	stratum := permutationElement(uint32(s.index)%strata, strata, uint32(hash(seed, round)))
+	return toInt63((float64(stratum) + s.rand.Float64()) / float64(strata))
+}
+
+// Returns the element at index i of a random permutation of 0 to l-1
+// chosen by p without building it (Kensler, "Correlated Multi-Jittered
+// Sampling", 2013).
+func permutationElement(i, l, p uint32) uint32 {
+	w := l - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+	for {
+		i ^= p
+		i *= 0xe170893d
+		i ^= p >> 16
+		i ^= (i & w) >> 4
+		i ^= p >> 8
+		i *= 0x0929eb3f
+		i ^= p >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | p>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < l {
+			break
+		}
+	}
+	return (i + p) % l
+}
+
+// HaltonSampler uses the Halton sequence, the radical inverse of the
+// sample index in the n-th prime base for dimension n. Every pixel shifts
+// every dimension by its own random offset (Cranley-Patterson rotation).
+// Dimensions past the last prime get independent random numbers.
+type HaltonSampler struct {
+	samplerState
+}
+
+var haltonPrimes = primes(64)
+
+// Returns the first n primes
+func primes(n int) []int {
+	var found []int
+	for candidate := 2; len(found) < n; candidate++ {
+		prime := true
+		for _, p := range found {
+			if candidate%p == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			found = append(found, candidate)
+		}
+	}
+	return found
+}
+
+func radicalInverse(base, index int) float64 {
+	inverse := 1 / float64(base)
+	factor := inverse
+	result := 0.0
+	for ; index > 0; index /= base {
+		result += float64(index%base) * factor
+		factor *= inverse
+	}
+	return result
+}
+
+func (s *HaltonSampler) Int63() int64 {
+	dimension, seed := s.next()
+	if dimension >= len(haltonPrimes) {
+		return s.rand.Int63()
+	}
+	offset := float64(seed>>11) / (1 << 53)
+	u := radicalInverse(haltonPrimes[dimension], s.index) + offset
+	return toInt63(u - math.Floor(u))
+}
+
+// SobolSampler draws every pair of dimensions from the first two
+// dimensions of the Sobol sequence, Owen scrambled with a hash (Burley,
+// "Practical Hash-based Owen Scrambling", 2020). Every pair shuffles the
+// sample index differently, so the pairs don't correlate, and every
+// pixel gets a differently scrambled sequence.
+type SobolSampler struct {
+	samplerState
+}
+
+// The direction numbers of the first two Sobol dimensions
+var sobolDirections = func() [2][32]uint32 {
+	var directions [2][32]uint32
+	v := uint32(1 << 31)
+	for bit := 0; bit < 32; bit++ {
+		directions[0][bit] = 1 << uint(31-bit)
+		directions[1][bit] = v
+		v ^= v >> 1
+	}
+	return directions
+}()
+
+func sobol(index uint32, dimension int) uint32 {
+	var x uint32
+	for bit := 0; index != 0; bit, index = bit+1, index>>1 {
+		if index&1 != 0 {
+			x ^= sobolDirections[dimension][bit]
+		}
+	}
+	return x
+}
+
+func reverseBits(x uint32) uint32 {
+	x = x<<16 | x>>16
+	x = (x&0x00ff00ff)<<8 | (x&0xff00ff00)>>8
+	x = (x&0x0f0f0f0f)<<4 | (x&0xf0f0f0f0)>>4
+	x = (x&0x33333333)<<2 | (x&0xcccccccc)>>2
+	return (x&0x55555555)<<1 | (x&0xaaaaaaaa)>>1
+}
+
+// A hash that only lets bits affect higher bits (Laine and Karras)
+func laineKarras(x, seed uint32) uint32 {
+	x += seed
+	x ^= x * 0x6c50b47c
+	x ^= x * 0xb82f1e52
+	x ^= x * 0xc7afe638
+	x ^= x * 0x8d22f6e6
+	return x
+}
+
+// Owen scrambling, every bit is flipped depending on the bits above it
+func owenScramble(x, seed uint32) uint32 {
+	return reverseBits(laineKarras(reverseBits(x), seed))
+}
+
+func (s *SobolSampler) Int63() int64 {
+	dimension, _ := s.next()
+	seed := hash(s.pixel, uint64(dimension/2))
+	index := owenScramble(uint32(s.index), uint32(seed))
+	x := owenScramble(sobol(index, dimension%2), uint32(hash(seed, uint64(dimension%2))))
+	// 32 bits of the sequence, the rest is jittered
+	u := (float64(x) + s.rand.Float64()) / (1 << 32)
+	return toInt63(math.Min(u, 1-1.0/(1<<53)))
+}
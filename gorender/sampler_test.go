@@ -0,0 +1,126 @@
+package gorender
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRadicalInverse(t *testing.T) {
+	tests := []struct {
+		base, index int
+		inverse     float64
+	}{
+		{2, 0, 0},
+		{2, 1, 0.5},
+		{2, 2, 0.25},
+		{2, 3, 0.75},
+		{2, 5, 0.625},
+		{3, 1, 1.0 / 3},
+		{3, 2, 2.0 / 3},
+		{3, 3, 1.0 / 9},
+		{3, 4, 4.0 / 9},
+		{5, 7, 2.0/5 + 1.0/25},
+	}
+	for _, test := range tests {
+		if inverse := radicalInverse(test.base, test.index); math.Abs(inverse-test.inverse) > 1e-12 {
+			t.Errorf("radicalInverse(%v, %v) = %v, want %v", test.base, test.index, inverse, test.inverse)
+		}
+	}
+}
+
+func TestSobol(t *testing.T) {
+	tests := []struct {
+		index     uint32
+		dimension int
+		x         uint32
+	}{
+		{0, 0, 0},
+		{1, 0, 0x80000000},
+		{2, 0, 0x40000000},
+		{3, 0, 0xc0000000},
+		{5, 0, 0xa0000000},
+		{0, 1, 0},
+		{1, 1, 0x80000000},
+		{2, 1, 0xc0000000},
+		{3, 1, 0x40000000},
+		{4, 1, 0xa0000000},
+	}
+	for _, test := range tests {
+		if x := sobol(test.index, test.dimension); x != test.x {
+			t.Errorf("sobol(%v, %v) = %#08x, want %#08x", test.index, test.dimension, x, test.x)
+		}
+	}
+}
+
+func TestOwenScramble(t *testing.T) {
+	tests := []struct {
+		x, y uint32
+		bits uint // The leading bits x and y share
+	}{
+		{0x00000000, 0xffffffff, 0},
+		{0x80000000, 0xffffffff, 1},
+		{0x12345678, 0x12345679, 31},
+		{0xdeadbeef, 0xdeadbeef, 32},
+		{0xf0000000, 0xffffffff, 4},
+	}
+	for _, seed := range []uint32{0, 1, 0x9e3779b9} {
+		for _, test := range tests {
+			x, y := owenScramble(test.x, seed), owenScramble(test.y, seed)
+			// Bits are only flipped depending on the bits above them, so
+			// the shared leading bits stay shared and the next one differs
+			shared := uint(32)
+			if difference := x ^ y; difference != 0 {
+				shared = uint(31 - math.Floor(math.Log2(float64(difference))))
+			}
+			if shared != test.bits {
+				t.Errorf("owenScramble(%#08x, %v) and owenScramble(%#08x, %v) share %v leading bits, want %v",
+					test.x, seed, test.y, seed, shared, test.bits)
+			}
+		}
+	}
+}
+
+// The first 2^m samples of every pair of dimensions of a pixel form a
+// (0, m, 2)-net: every elementary interval of area 2^-m holds one sample.
+func TestSobolSamplerNets(t *testing.T) {
+	tests := []struct {
+		seed       int64
+		x, y, pair int
+	}{
+		{1, 0, 0, 0},
+		{1, 5, 3, 0},
+		{2, 5, 3, 1},
+		{42, 100, 7, 3},
+	}
+	for _, test := range tests {
+		for m := uint(0); m <= 8; m++ {
+			samples := 1 << m
+			sampler := Samplers["sobol"](samples, test.seed)
+			sampler.StartPixel(test.x, test.y)
+			points := make([][2]float64, samples)
+			for i := range points {
+				sampler.StartSample(i)
+				for dimension := 0; dimension < 2*test.pair; dimension++ {
+					sampler.Int63()
+				}
+				points[i][0] = float64(sampler.Int63()) / (1 << 63)
+				points[i][1] = float64(sampler.Int63()) / (1 << 63)
+			}
+
+			for a := uint(0); a <= m; a++ {
+				cols, rows := 1<<a, 1<<(m-a)
+				found := make([]int, samples)
+				for _, point := range points {
+					found[int(point[1]*float64(rows))*cols+int(point[0]*float64(cols))]++
+				}
+				for cell, count := range found {
+					if count != 1 {
+						t.Errorf("seed %v, pixel %v,%v, pair %v: %v samples in cell %v of %vx%v, want 1",
+							test.seed, test.x, test.y, test.pair, count, cell, cols, rows)
+						break
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"math/rand"
+)
+
+////////////////////
+// Sampling
+////////////////////
+
+// Returns a uniformly distributed direction within the cone around axis
+// whose half angle has the cosine cosMax.
+func SampleCone(axis geometry.Vec3, cosMax geometry.Float, rand *rand.Rand) geometry.Vec3 {
+	cosTheta := 1 - rand.Float64()*(1-float64(cosMax))
+	sinTheta := math.Sqrt(math.Max(0, 1-cosTheta*cosTheta))
+	phi := 2 * math.Pi * rand.Float64()
+
+	u, v := axis.Basis()
+	return u.Mult(geometry.Float(sinTheta * math.Cos(phi))).
+		Add(v.Mult(geometry.Float(sinTheta * math.Sin(phi)))).
+		Add(axis.Mult(geometry.Float(cosTheta))).Normalize()
+}
+
+// Returns a cosine weighted direction in the hemisphere around normal
+// together with its probability density per solid angle.
+func SampleCosineHemisphere(normal geometry.Vec3, rand *rand.Rand) (geometry.Vec3, float64) {
+	r := math.Sqrt(rand.Float64())
+	phi := 2 * math.Pi * rand.Float64()
+	cosTheta := math.Sqrt(math.Max(0, 1-r*r))
+
+	u, v := normal.Basis()
+	direction := u.Mult(geometry.Float(r * math.Cos(phi))).
+		Add(v.Mult(geometry.Float(r * math.Sin(phi)))).
+		Add(normal.Mult(geometry.Float(cosTheta))).Normalize()
+	return direction, cosTheta / math.Pi
+}
+
+// The probability density per solid angle of a direction sampled
+// uniformly within a cone.
+func ConePdf(cosMax float64) float64 {
+	return 1 / (2 * math.Pi * (1 - cosMax))
+}
+
+// Weights a sample drawn with density pdfA against another strategy with
+// density pdfB using Veach's power heuristic with an exponent of two.
+func PowerHeuristic(pdfA, pdfB float64) float64 {
+	a, b := pdfA*pdfA, pdfB*pdfB
+	if a+b == 0 {
+		return 0
+	}
+	return a / (a + b)
+}
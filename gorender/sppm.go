@@ -0,0 +1,168 @@
+package gorender
+
+import (
+	"fmt"
+	"github.com/Nightgunner5/goray/geometry"
+	"image"
+	"math"
+	"math/rand"
+)
+
+////////////////////////////////////////
+// Stochastic progressive photon mapping
+////////////////////////////////////////
+
+// SPPM alternates camera passes, which find the diffuse surface seen
+// through every pixel, with photon passes that add up the photons landing
+// near those surfaces. Every pixel's gather radius shrinks as photons
+// accumulate (Hachisuka and Jensen, 2009), so caustics and light seen
+// through glass keep converging with every pass instead of being limited
+// by the size of a photon map.
+//
+// Config.NumRays sets the number of passes, Config.Photons the photons
+// per light and pass and Config.GatherRadius the initial radius.
+type SPPM struct {
+	Scene  *geometry.Scene
+	Lights *LightSampler
+}
+
+// The share of new photons kept when shrinking the radius
+const sppmAlpha = 0.7
+
+type sppmPixel struct {
+	radius2 geometry.Float
+	photons float64
+	flux    geometry.Vec3
+	direct  geometry.Vec3
+
+	// The surface seen in the current pass
+	visible                  bool
+	position, normal, albedo geometry.Vec3
+}
+
+// Returns the light reaching the camera along ray that doesn't come from
+// photons: emission, the sky and direct light on the visible surface.
+func (s *SPPM) Radiance(ray geometry.Ray, rand *rand.Rand) geometry.Vec3 {
+	direct, _ := s.trace(ray, nil, rand)
+	return direct
+}
+
+// Follows ray through mirrors and glass to the first diffuse surface and
+// records it in pixel if pixel isn't nil.
+func (s *SPPM) trace(ray geometry.Ray, pixel *sppmPixel, rand *rand.Rand) (geometry.Vec3, bool) {
+	scene := s.Scene
+	for depth := 0; depth < maxSpecularDepth; depth++ {
+		shape, distance := ClosestIntersection(scene.Objects, ray)
+		if shape == nil {
+			return missRadiance(ray, scene, s.Lights, 0), false
+		}
+		impact := ray.Origin.Add(ray.Direction.Mult(distance))
+		normal := shape.NormalDir(impact).Normalize()
+		outgoing := normal
+		if normal.Dot(ray.Direction) > 0 {
+			outgoing = normal.Mult(-1)
+		}
+
+		if shape.Material != geometry.DIFFUSE {
+			ray = specularBounce(ray, shape, impact, normal, outgoing, rand)
+			continue
+		}
+
+		if pixel != nil {
+			pixel.position, pixel.normal, pixel.albedo = impact, outgoing, shape.Colour
+		}
+		direct := shape.Colour.MultVec(directLighting(impact, outgoing, shape, scene, s.Lights, rand))
+		return shape.Emission.Add(direct), true
+	}
+	return geometry.Vec3{0, 0, 0}, false
+}
+
+// Runs f for every tile of the image in parallel, with random numbers
+// seeded by the tile and the next number of source
+func (s *SPPM) parallel(source *rand.Rand, f func(tile image.Rectangle, rand *rand.Rand)) {
+	seed := source.Int63()
+	renderTiles(Tiles(s.Scene.Cols, s.Scene.Rows), func(worker, index int, tile image.Rectangle) {
+		f(tile, rand.New(rand.NewSource(tileSeed(seed, index))))
+	})
+}
+
+func (s *SPPM) RenderFrame(film *Film, source *rand.Rand) {
+	scene := s.Scene
+	pixels := make([]sppmPixel, scene.Rows*scene.Cols)
+	for i := range pixels {
+		pixels[i].radius2 = geometry.Float(Config.GatherRadius * Config.GatherRadius)
+	}
+
+	passes := Config.NumRays
+	factor := int(math.Sqrt(float64(Config.Photons) / 2))
+	for pass := 0; pass < passes; pass++ {
+		fmt.Printf("Progressive photon mapping pass %v/%v\n", pass+1, passes)
+
+		s.parallel(source, func(tile image.Rectangle, rand *rand.Rand) {
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				for x := tile.Min.X; x < tile.Max.X; x++ {
+					pixel := &pixels[y*scene.Cols+x]
+					pixel.visible = false
+					if Skipped(scene, x, y) {
+						continue
+					}
+					direct, visible := s.trace(CameraRay(scene, x, y, rand), pixel, rand)
+					pixel.direct.AddInPlace(direct)
+					pixel.visible = visible
+				}
+			}
+		})
+
+		// Direct light was estimated by the camera pass, only photons that
+		// bounced at least once are gathered
+		_, hits := PhotonMapping(scene, factor, DiffusePhoton)
+		var indirect []PhotonHit
+		for _, photon := range hits {
+			if photon.Depth > 0 {
+				indirect = append(indirect, photon)
+			}
+		}
+		photonMap := <-buildMap(indirect)
+
+		s.parallel(source, func(tile image.Rectangle, rand *rand.Rand) {
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				for x := tile.Min.X; x < tile.Max.X; x++ {
+					pixel := &pixels[y*scene.Cols+x]
+					if !pixel.visible {
+						continue
+					}
+
+					var found float64
+					var flux geometry.Vec3
+					radius := geometry.Float(math.Sqrt(float64(pixel.radius2)))
+					for _, node := range photonMap.Neighbors(pixel.position, radius) {
+						photon := node.Item.(PhotonHit)
+						if photon.Incomming.Dot(pixel.normal) < 0 {
+							found++
+							flux.AddInPlace(photon.Photon)
+						}
+					}
+					if found == 0 {
+						continue
+					}
+
+					// Keep a fraction of the new photons and shrink the radius
+					// so the photon density stays the same
+					photons := pixel.photons + sppmAlpha*found
+					ratio := geometry.Float(photons / (pixel.photons + found))
+					pixel.radius2 *= ratio
+					pixel.photons = photons
+					pixel.flux = pixel.flux.Add(pixel.albedo.MultVec(flux).Mult(1 / math.Pi)).Mult(ratio)
+				}
+			}
+		})
+	}
+
+	for y := 0; y < scene.Rows; y++ {
+		for x := 0; x < scene.Cols; x++ {
+			pixel := &pixels[y*scene.Cols+x]
+			colour := pixel.direct.Add(pixel.flux.Mult(1 / (math.Pi * pixel.radius2)))
+			film.Set(x, y, colour.Mult(1/geometry.Float(passes)))
+		}
+	}
+}
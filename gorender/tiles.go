@@ -0,0 +1,148 @@
+package gorender
+
+import (
+	"image"
+	"sort"
+	"sync"
+)
+
+////////////////////
+// Tiles
+////////////////////
+
+// A TileOrder returns the positions of all tiles in a grid of cols x rows
+// tiles in the order they are rendered
+type TileOrder func(cols, rows int) []image.Point
+
+// The tile orders selectable by name with Config.TileOrder
+var TileOrders = map[string]TileOrder{
+	// Row by row from the top
+	"scanline": func(cols, rows int) []image.Point {
+		var order []image.Point
+		for y := 0; y < rows; y++ {
+			for x := 0; x < cols; x++ {
+				order = append(order, image.Point{x, y})
+			}
+		}
+		return order
+	},
+	// Outwards from the centre, which is usually the interesting part
+	"spiral": func(cols, rows int) []image.Point {
+		var order []image.Point
+		position := image.Point{(cols - 1) / 2, (rows - 1) / 2}
+		directions := []image.Point{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+		add := func() {
+			if position.X >= 0 && position.X < cols && position.Y >= 0 && position.Y < rows {
+				order = append(order, position)
+			}
+		}
+		add()
+		// The legs of the spiral grow by one after every second turn
+		for leg := 0; len(order) < cols*rows; leg++ {
+			direction := directions[leg%4]
+			for i := 0; i < leg/2+1; i++ {
+				position = position.Add(direction)
+				add()
+			}
+		}
+		return order
+	},
+	// Along a Hilbert curve, which keeps neighbouring tiles close in time
+	// and what they hit in the caches
+	"hilbert": func(cols, rows int) []image.Point {
+		size := 1
+		for size < cols || size < rows {
+			size *= 2
+		}
+		var order []image.Point
+		for d := 0; d < size*size; d++ {
+			if p := hilbertPoint(size, d); p.X < cols && p.Y < rows {
+				order = append(order, p)
+			}
+		}
+		return order
+	},
+}
+
+// Returns the point at distance d along the Hilbert curve filling a square
+// of size x size, a power of two
+func hilbertPoint(size, d int) image.Point {
+	var p image.Point
+	for s := 1; s < size; s *= 2 {
+		rx := 1 & (d / 2)
+		ry := 1 & (d ^ rx)
+		// Rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				p.X, p.Y = s-1-p.X, s-1-p.Y
+			}
+			p.X, p.Y = p.Y, p.X
+		}
+		p.X += s * rx
+		p.Y += s * ry
+		d /= 4
+	}
+	return p
+}
+
+// Returns the names of all tile orders in alphabetical order
+func TileOrderNames() []string {
+	var names []string
+	for name := range TileOrders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Splits an image of cols x rows pixels into tiles of Config.TileSize
+// pixels, smaller at the right and bottom edges, in Config.TileOrder
+func Tiles(cols, rows int) []image.Rectangle {
+	size := Config.TileSize
+	var tiles []image.Rectangle
+	for _, p := range TileOrders[Config.TileOrder]((cols+size-1)/size, (rows+size-1)/size) {
+		tile := image.Rect(p.X*size, p.Y*size, (p.X+1)*size, (p.Y+1)*size)
+		tiles = append(tiles, tile.Intersect(image.Rect(0, 0, cols, rows)))
+	}
+	return tiles
+}
+
+// Runs work for every tile on Config.Workers goroutines, which take the
+// next tile from a queue whenever they finish one, so the load stays
+// balanced however much the tiles differ in cost. work is told which
+// worker runs it and the index of the tile, and returns when all tiles
+// are done. Which worker gets a tile depends on scheduling, so anything
+// random about a tile must come from its index, see tileSeed.
+func renderTiles(tiles []image.Rectangle, work func(worker, index int, tile image.Rectangle)) {
+	queue := make(chan int, len(tiles))
+	for index := range tiles {
+		queue <- index
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers(); worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			for index := range queue {
+				work(worker, index, tiles[index])
+			}
+			wg.Done()
+		}(worker)
+	}
+	wg.Wait()
+}
+
+// Returns the seed for the random numbers of tile index, so renders with
+// the same seed are the same however the tiles are scheduled
+func tileSeed(seed int64, index int) int64 {
+	return int64(hash(uint64(seed), uint64(index)) >> 1)
+}
+
+// The number of worker goroutines, at least one
+func workers() int {
+	if Config.Workers < 1 {
+		return 1
+	}
+	return Config.Workers
+}
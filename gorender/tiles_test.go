@@ -0,0 +1,82 @@
+package gorender
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestTileOrders(t *testing.T) {
+	tests := []struct {
+		order      string
+		cols, rows int
+		first      []image.Point // The start of the order, if it is checked
+	}{
+		{"scanline", 3, 2, []image.Point{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 1}, {2, 1}}},
+		{"scanline", 1, 1, []image.Point{{0, 0}}},
+		{"spiral", 3, 3, []image.Point{{1, 1}, {2, 1}, {2, 2}, {1, 2}, {0, 2}, {0, 1}, {0, 0}, {1, 0}, {2, 0}}},
+		{"spiral", 4, 2, []image.Point{{1, 0}, {2, 0}, {2, 1}, {1, 1}, {0, 1}, {0, 0}}},
+		{"spiral", 7, 1, nil},
+		{"spiral", 1, 5, nil},
+		{"hilbert", 2, 2, []image.Point{{0, 0}, {0, 1}, {1, 1}, {1, 0}}},
+		{"hilbert", 5, 3, nil},
+		{"hilbert", 8, 8, nil},
+	}
+	for _, test := range tests {
+		order := TileOrders[test.order](test.cols, test.rows)
+		if test.first != nil && !reflect.DeepEqual(order[:len(test.first)], test.first) {
+			t.Errorf("%v of %vx%v starts with %v, want %v", test.order, test.cols, test.rows, order[:len(test.first)], test.first)
+		}
+
+		// Every tile comes exactly once
+		seen := make(map[image.Point]bool)
+		for _, p := range order {
+			if p.X < 0 || p.X >= test.cols || p.Y < 0 || p.Y >= test.rows || seen[p] {
+				t.Errorf("%v of %vx%v has %v outside of the grid or twice", test.order, test.cols, test.rows, p)
+			}
+			seen[p] = true
+		}
+		if len(order) != test.cols*test.rows {
+			t.Errorf("%v of %vx%v has %v tiles, want %v", test.order, test.cols, test.rows, len(order), test.cols*test.rows)
+		}
+	}
+}
+
+// On a square grid of a power of two the Hilbert curve only ever steps to
+// a neighbouring tile
+func TestHilbertSteps(t *testing.T) {
+	for _, size := range []int{2, 4, 8, 16} {
+		order := TileOrders["hilbert"](size, size)
+		for i := 1; i < len(order); i++ {
+			step := order[i].Sub(order[i-1])
+			if step.X*step.X+step.Y*step.Y != 1 {
+				t.Errorf("hilbert of %vx%v steps from %v to %v", size, size, order[i-1], order[i])
+			}
+		}
+	}
+}
+
+func TestTiles(t *testing.T) {
+	defer func(size int, order string) {
+		Config.TileSize, Config.TileOrder = size, order
+	}(Config.TileSize, Config.TileOrder)
+
+	tests := []struct {
+		size, cols, rows int
+		tiles            []image.Rectangle
+	}{
+		{4, 4, 4, []image.Rectangle{image.Rect(0, 0, 4, 4)}},
+		{8, 5, 3, []image.Rectangle{image.Rect(0, 0, 5, 3)}},
+		// Smaller at the right and bottom edges
+		{4, 10, 6, []image.Rectangle{
+			image.Rect(0, 0, 4, 4), image.Rect(4, 0, 8, 4), image.Rect(8, 0, 10, 4),
+			image.Rect(0, 4, 4, 6), image.Rect(4, 4, 8, 6), image.Rect(8, 4, 10, 6),
+		}},
+	}
+	for _, test := range tests {
+		Config.TileSize, Config.TileOrder = test.size, "scanline"
+		if tiles := Tiles(test.cols, test.rows); !reflect.DeepEqual(tiles, test.tiles) {
+			t.Errorf("Tiles of %v for %vx%v are %v, want %v", test.size, test.cols, test.rows, tiles, test.tiles)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package gorender
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"sort"
+)
+
+////////////////////
+// Tone mapping
+////////////////////
+
+// A ToneMapper compresses the linear radiance of a pixel into the range
+// from 0 to 1 that can be displayed. Gamma correction comes afterwards.
+type ToneMapper func(colour geometry.Vec3) geometry.Vec3
+
+// The tone mappers selectable by name with Config.ToneMapper
+var ToneMappers = map[string]ToneMapper{
+	// Clips everything brighter than 1
+	"linear": func(colour geometry.Vec3) geometry.Vec3 {
+		return colour.CLAMPF()
+	},
+	// Extended Reinhard on the luminance, which maps Config.WhitePoint to 1
+	"reinhard": func(colour geometry.Vec3) geometry.Vec3 {
+		l := luminance(colour)
+		if l <= 0 {
+			return geometry.Vec3{0, 0, 0}
+		}
+		white2 := Config.WhitePoint * Config.WhitePoint
+		mapped := l * (1 + l/white2) / (1 + l)
+		return colour.Mult(geometry.Float(mapped / l)).CLAMPF()
+	},
+	// Narkowicz's fit of the ACES filmic curve
+	"aces": func(colour geometry.Vec3) geometry.Vec3 {
+		return mapChannels(colour, func(x float64) float64 {
+			// The fit expects the exposure of the reference transform
+			x *= 0.6
+			return x * (2.51*x + 0.03) / (x*(2.43*x+0.59) + 0.14)
+		}).CLAMPF()
+	},
+	// Hable's filmic curve from Uncharted 2
+	"hable": func(colour geometry.Vec3) geometry.Vec3 {
+		return mapChannels(colour, func(x float64) float64 {
+			return hable(2*x) / hable(hableWhite)
+		}).CLAMPF()
+	},
+}
+
+// The linear value that Hable's curve maps to white
+const hableWhite = 11.2
+
+func hable(x float64) float64 {
+	const (
+		shoulder = 0.15
+		linear   = 0.5
+		angle    = 0.1
+		toe      = 0.2
+		toeNum   = 0.02
+		toeDenom = 0.3
+	)
+	return (x*(shoulder*x+angle*linear)+toe*toeNum)/(x*(shoulder*x+linear)+toe*toeDenom) - toeNum/toeDenom
+}
+
+func mapChannels(colour geometry.Vec3, f func(float64) float64) geometry.Vec3 {
+	return geometry.Vec3{
+		geometry.Float(f(math.Max(0, float64(colour.X)))),
+		geometry.Float(f(math.Max(0, float64(colour.Y)))),
+		geometry.Float(f(math.Max(0, float64(colour.Z)))),
+	}
+}
+
+// Returns the names of all tone mappers in alphabetical order
+func ToneMapperNames() []string {
+	var names []string
+	for name := range ToneMappers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Scales colour by Config.Exposure, in stops, and maps it with
+// Config.ToneMapper.
+func ToneMap(colour geometry.Vec3) geometry.Vec3 {
+	return ToneMappers[Config.ToneMapper](expose(colour))
+}
+
+func expose(colour geometry.Vec3) geometry.Vec3 {
+	return colour.Mult(geometry.Float(math.Exp2(Config.Exposure)))
+}
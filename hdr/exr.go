@@ -0,0 +1,203 @@
+package hdr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+////////////////////////
+// OpenEXR
+////////////////////////
+
+// The pixel types of OpenEXR channels
+type PixelType int32
+
+const (
+	Half  PixelType = 1 // 16 bit floats
+	Float PixelType = 2 // 32 bit floats
+)
+
+// The compression methods of OpenEXR supported by EncodeEXR
+type Compression uint8
+
+const (
+	NoCompression  Compression = 0
+	ZipCompression Compression = 3 // zlib in blocks of 16 scanlines
+)
+
+// The scanlines stored together in a chunk of the file
+func (c Compression) linesPerChunk() int {
+	if c == ZipCompression {
+		return 16
+	}
+	return 1
+}
+
+// Writes every channel of img to a single part scanline OpenEXR file with
+// the given pixel type and compression.
+func EncodeEXR(w io.Writer, img *Image, pixelType PixelType, compression Compression) error {
+	names := img.Names()
+	header := new(bytes.Buffer)
+	le := binary.LittleEndian
+
+	// Magic number and version 2, with long names if needed
+	binary.Write(header, le, uint32(20000630))
+	flags := uint32(2)
+	for _, name := range names {
+		if len(name) > 31 {
+			flags |= 0x400
+		}
+	}
+	binary.Write(header, le, flags)
+
+	channels := new(bytes.Buffer)
+	for _, name := range names {
+		channels.WriteString(name)
+		channels.WriteByte(0)
+		binary.Write(channels, le, pixelType)
+		channels.Write([]byte{0, 0, 0, 0}) // Not perceptually linear, reserved
+		binary.Write(channels, le, [2]int32{1, 1})
+	}
+	channels.WriteByte(0)
+	window := new(bytes.Buffer)
+	binary.Write(window, le, [4]int32{0, 0, int32(img.Width - 1), int32(img.Height - 1)})
+	attribute := func(name, kind string, value []byte) {
+		header.WriteString(name)
+		header.WriteByte(0)
+		header.WriteString(kind)
+		header.WriteByte(0)
+		binary.Write(header, le, int32(len(value)))
+		header.Write(value)
+	}
+	float := func(values ...float32) []byte {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, le, values)
+		return buf.Bytes()
+	}
+	attribute("channels", "chlist", channels.Bytes())
+	attribute("compression", "compression", []byte{byte(compression)})
+	attribute("dataWindow", "box2i", window.Bytes())
+	attribute("displayWindow", "box2i", window.Bytes())
+	attribute("lineOrder", "lineOrder", []byte{0}) // Increasing y
+	attribute("pixelAspectRatio", "float", float(1))
+	attribute("screenWindowCenter", "v2f", float(0, 0))
+	attribute("screenWindowWidth", "float", float(1))
+	header.WriteByte(0)
+
+	// Every chunk holds its scanlines one after the other, each with the
+	// values of one channel after the other
+	lines := compression.linesPerChunk()
+	size := 4
+	if pixelType == Half {
+		size = 2
+	}
+	var chunks [][]byte
+	for start := 0; start < img.Height; start += lines {
+		var data []byte
+		line := make([]byte, size*img.Width)
+		for y := start; y < start+lines && y < img.Height; y++ {
+			for _, name := range names {
+				for x, value := range img.Channels[name][y*img.Width : (y+1)*img.Width] {
+					if pixelType == Half {
+						le.PutUint16(line[2*x:], toHalf(value))
+					} else {
+						le.PutUint32(line[4*x:], math.Float32bits(value))
+					}
+				}
+				data = append(data, line...)
+			}
+		}
+		if compression == ZipCompression {
+			// Chunks that don't get smaller are stored as they are
+			if compressed := zipChunk(data); len(compressed) < len(data) {
+				data = compressed
+			}
+		}
+		chunk := new(bytes.Buffer)
+		binary.Write(chunk, le, [2]int32{int32(start), int32(len(data))})
+		chunk.Write(data)
+		chunks = append(chunks, chunk.Bytes())
+	}
+
+	// The offset table points at every chunk from the start of the file
+	offset := uint64(header.Len() + 8*len(chunks))
+	for _, chunk := range chunks {
+		binary.Write(header, le, offset)
+		offset += uint64(len(chunk))
+	}
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compresses a chunk like OpenEXR's zip compression: the bytes are split
+// into the even and the odd ones, replaced by their differences and then
+// deflated.
+func zipChunk(data []byte) []byte {
+	reordered := make([]byte, len(data))
+	half := (len(data) + 1) / 2
+	for i, b := range data {
+		if i%2 == 0 {
+			reordered[i/2] = b
+		} else {
+			reordered[half+i/2] = b
+		}
+	}
+	for i := len(reordered) - 1; i > 0; i-- {
+		reordered[i] = reordered[i] - reordered[i-1] + 128
+	}
+
+	compressed := new(bytes.Buffer)
+	writer := zlib.NewWriter(compressed)
+	writer.Write(reordered)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+// Converts f to a 16 bit float, rounding to the nearest even
+func toHalf(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exponent := int(bits>>23&0xff) - 127 + 15
+	mantissa := bits & 0x7fffff
+
+	switch {
+	case bits&0x7f800000 == 0x7f800000:
+		// Infinity and NaN
+		if mantissa != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exponent >= 31:
+		return sign | 0x7c00
+	case exponent <= 0:
+		// Too small for a normal half, denormalised or zero
+		if exponent < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint(14 - exponent)
+		half := mantissa >> shift
+		rest, middle := mantissa&(1<<shift-1), uint32(1)<<(shift-1)
+		if rest > middle || rest == middle && half&1 == 1 {
+			half++
+		}
+		return sign | uint16(half)
+	}
+
+	// Rounding up may carry into the exponent, which is still right
+	half := uint32(exponent)<<10 | mantissa>>13
+	if rest := mantissa & 0x1fff; rest > 0x1000 || rest == 0x1000 && half&1 == 1 {
+		half++
+	}
+	return sign | uint16(half)
+}
@@ -0,0 +1,79 @@
+package hdr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func TestToHalf(t *testing.T) {
+	tests := []struct {
+		f    float32
+		half uint16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{0.5, 0x3800},
+		{0.1, 0x2e66},
+		{65504, 0x7bff},
+		// Halfway between the largest half and infinity rounds to even
+		{65520, 0x7c00},
+		{1e6, 0x7c00},
+		{-1e6, 0xfc00},
+		{float32(math.Inf(+1)), 0x7c00},
+		{float32(math.Inf(-1)), 0xfc00},
+		{float32(math.NaN()), 0x7e00},
+		// Halfway between 1 and the next half rounds to even, down here
+		{1 + 1.0/(1<<11), 0x3c00},
+		{1 + 3.0/(1<<11), 0x3c02},
+		// The smallest normal half and the denormals below it
+		{1.0 / (1 << 14), 0x0400},
+		{1.0/(1<<14) - 1.0/(1<<24), 0x03ff},
+		{1.0 / (1 << 24), 0x0001},
+		{1.0 / (1 << 25), 0x0000},
+		{1.5 / (1 << 25), 0x0001},
+		{-1.0 / (1 << 24), 0x8001},
+		{1e-10, 0x0000},
+	}
+	for _, test := range tests {
+		if half := toHalf(test.f); half != test.half {
+			t.Errorf("toHalf(%v) = %#04x, want %#04x", test.f, half, test.half)
+		}
+	}
+}
+
+func TestZipChunk(t *testing.T) {
+	tests := []struct {
+		data, predicted []byte
+	}{
+		{[]byte{}, []byte{}},
+		{[]byte{7}, []byte{7}},
+		{[]byte{1, 2}, []byte{1, 129}},
+		// Even bytes first, then the odd ones, each replaced by its
+		// difference to the one before plus 128
+		{[]byte{1, 2, 3, 4, 5}, []byte{1, 130, 130, 125, 130}},
+		{[]byte{10, 10, 10, 10}, []byte{10, 128, 128, 128}},
+		// Differences wrap around
+		{[]byte{0, 255}, []byte{0, 127}},
+		{[]byte{255, 0}, []byte{255, 129}},
+	}
+	for _, test := range tests {
+		reader, err := zlib.NewReader(bytes.NewReader(zipChunk(test.data)))
+		if err != nil {
+			t.Errorf("zipChunk(%v) is not zlib data: %v", test.data, err)
+			continue
+		}
+		predicted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Errorf("zipChunk(%v) is not zlib data: %v", test.data, err)
+			continue
+		}
+		if !bytes.Equal(predicted, test.predicted) {
+			t.Errorf("zipChunk(%v) holds %v, want %v", test.data, predicted, test.predicted)
+		}
+	}
+}
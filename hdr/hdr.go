@@ -0,0 +1,100 @@
+package hdr
+
+import (
+	"sort"
+	"strings"
+)
+
+////////////////////////
+// Float images
+////////////////////////
+
+// Image is a high dynamic range image of 32 bit floats. Channels are named
+// like R, G and B, or layer.channel like normal.X for further layers, and
+// hold Width*Height values each, row by row from the top.
+type Image struct {
+	Width, Height int
+	Channels      map[string][]float32
+}
+
+func NewImage(width, height int) *Image {
+	return &Image{width, height, make(map[string][]float32)}
+}
+
+// Returns the channel with the given name, adding it if it doesn't exist
+func (img *Image) Channel(name string) []float32 {
+	channel, ok := img.Channels[name]
+	if !ok {
+		channel = make([]float32, img.Width*img.Height)
+		img.Channels[name] = channel
+	}
+	return channel
+}
+
+// Returns the names of the channels in alphabetical order
+func (img *Image) Names() []string {
+	var names []string
+	for name := range img.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the layers of the image as images of their own by name, for
+// formats that hold nothing but a colour. The R, G and B channels of a
+// layer stay as they are, X, Y and Z become R, G and B and the only channel
+// of a layer fills all three.
+func (img *Image) Layers() map[string]*Image {
+	channels := make(map[string]map[string][]float32)
+	for name, values := range img.Channels {
+		dot := strings.LastIndex(name, ".")
+		if dot < 0 {
+			continue
+		}
+		layer := name[:dot]
+		if channels[layer] == nil {
+			channels[layer] = make(map[string][]float32)
+		}
+		channels[layer][name[dot+1:]] = values
+	}
+
+	layers := make(map[string]*Image)
+	for name, found := range channels {
+		layer := NewImage(img.Width, img.Height)
+		var only []float32
+		for _, values := range found {
+			only = values
+		}
+		for i, channel := range []string{"R", "G", "B"} {
+			values, ok := found[channel]
+			if !ok {
+				values, ok = found[[]string{"X", "Y", "Z"}[i]]
+			}
+			if !ok && len(found) == 1 {
+				values, ok = only, true
+			}
+			if ok {
+				layer.Channels[channel] = values
+			}
+		}
+		layers[name] = layer
+	}
+	return layers
+}
+
+// Returns the colour of pixel x, y from the R, G and B channels, which are
+// zero if missing
+func (img *Image) RGB(x, y int) (r, g, b float32) {
+	i := y*img.Width + x
+	if channel, ok := img.Channels["R"]; ok {
+		r = channel[i]
+	}
+	if channel, ok := img.Channels["G"]; ok {
+		g = channel[i]
+	}
+	if channel, ok := img.Channels["B"]; ok {
+		b = channel[i]
+	}
+	return
+}
@@ -0,0 +1,31 @@
+package hdr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+////////////////////////
+// Portable float map
+////////////////////////
+
+// Writes the R, G and B channels of img as a colour PFM file, little
+// endian 32 bit floats with the bottom row first
+func EncodePFM(w io.Writer, img *Image) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "PF\n%v %v\n-1.0\n", img.Width, img.Height)
+	buf := make([]byte, 12)
+	for y := img.Height - 1; y >= 0; y-- {
+		for x := 0; x < img.Width; x++ {
+			r, g, b := img.RGB(x, y)
+			binary.LittleEndian.PutUint32(buf[0:], math.Float32bits(r))
+			binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(g))
+			binary.LittleEndian.PutUint32(buf[8:], math.Float32bits(b))
+			out.Write(buf)
+		}
+	}
+	return out.Flush()
+}
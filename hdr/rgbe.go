@@ -0,0 +1,48 @@
+package hdr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+////////////////////////
+// Radiance RGBE
+////////////////////////
+
+// Writes the R, G and B channels of img as a Radiance .hdr file. Every
+// pixel is stored as three 8 bit mantissas sharing an exponent, in flat
+// scanlines which every reader understands. Negative values are written as
+// zero.
+func EncodeRGBE(w io.Writer, img *Image) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %v +X %v\n", img.Height, img.Width)
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			out.Write(toRGBE(img.RGB(x, y)))
+		}
+	}
+	return out.Flush()
+}
+
+func toRGBE(r, g, b float32) []byte {
+	r, g, b = positive(r), positive(g), positive(b)
+	v := math.Max(float64(r), math.Max(float64(g), float64(b)))
+	if v < 1e-32 {
+		return []byte{0, 0, 0, 0}
+	}
+	mantissa, exponent := math.Frexp(v)
+	scale := mantissa * 256 / v
+	return []byte{byte(float64(r) * scale), byte(float64(g) * scale), byte(float64(b) * scale), byte(exponent + 128)}
+}
+
+func positive(x float32) float32 {
+	if x > 0 && !math.IsInf(float64(x), 0) {
+		return x
+	}
+	if x > 0 {
+		return math.MaxFloat32
+	}
+	return 0
+}
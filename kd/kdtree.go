@@ -1,6 +1,7 @@
 package kd
 
 import (
+	"container/heap"
 	"github.com/Nightgunner5/goray/geometry"
 	"sort"
 )
@@ -11,10 +12,24 @@ const (
 	DIM_Z = 2
 )
 
+// Anything that has a position can be stored in the tree
+type Item interface {
+	Position() geometry.Vec3
+}
+
+// Wraps plain positions so they can be stored as items
+type point geometry.Vec3
+
+func (p point) Position() geometry.Vec3 {
+	return geometry.Vec3(p)
+}
+
 // The KDNodes are the nodes in the tree
-// It has a value, a splitting dimension and left and right childs.
+// It has a value, the item it was created from, a splitting dimension
+// and left and right childs.
 type KDNode struct {
 	Position    geometry.Vec3
+	Item        Item
 	Split       int
 	Left, Right *KDNode
 }
@@ -48,7 +63,7 @@ func comparingValue(item geometry.Vec3, dimension int) geometry.Float {
 // in the Go standard library
 ///////////////////////////////
 type valueList struct {
-	values    []geometry.Vec3
+	values    []Item
 	dimension int
 }
 
@@ -57,7 +72,7 @@ func (l valueList) Len() int {
 }
 
 func (l valueList) Less(i, j int) bool {
-	return comparingValue(l.values[i], l.dimension) < comparingValue(l.values[j], l.dimension)
+	return comparingValue(l.values[i].Position(), l.dimension) < comparingValue(l.values[j].Position(), l.dimension)
 }
 
 func (l valueList) Swap(i, j int) {
@@ -93,6 +108,17 @@ func AsyncNew(items []geometry.Vec3, maxDimension int) <-chan *KDNode {
 	return channel
 }
 
+// Like AsyncNew but keeps the items in the nodes
+func AsyncNewItems(items []Item, maxDimension int) <-chan *KDNode {
+	channel := make(chan *KDNode)
+
+	go func() {
+		channel <- NewItems(items, maxDimension)
+	}()
+
+	return channel
+}
+
 // Helper function to conditionally branch with go
 func condGo(condition bool, f func()) {
 	if condition {
@@ -110,39 +136,87 @@ func condGo(condition bool, f func()) {
 // Every level creates one new Go routine and processes one sub-tree
 // on it's own.
 func New(items []geometry.Vec3, maxDimension int) *KDNode {
-	var create func([]geometry.Vec3, chan *KDNode, int)
-	create = func(l []geometry.Vec3, result chan *KDNode, depth int) {
+	points := make([]Item, len(items))
+	for i, item := range items {
+		points[i] = point(item)
+	}
+	return NewItems(points, maxDimension)
+}
+
+// Creates a new KD-tree from the positions of items. Every node keeps the
+// item it was created from, so payloads can be looked up after a search.
+func NewItems(items []Item, maxDimension int) *KDNode {
+	// All nodes live in one slice, a node's index is the index of its
+	// item after sorting. Neighbours in space end up close in memory
+	// and the goroutines never write to the same node.
+	nodes := make([]KDNode, len(items))
+
+	var create func([]Item, int, chan *KDNode, int)
+	create = func(l []Item, offset int, result chan *KDNode, depth int) {
 		if len(l) == 0 {
 			result <- nil
 			return
 		}
 
+		// Split along the dimension with the largest spread. Photons on
+		// a plane share one coordinate, splitting on it would not prune
+		// anything when searching.
+		dimension := widestDimension(l, maxDimension)
+
 		// Sort the array
-		sort.Sort(valueList{l, depth % maxDimension})
+		sort.Sort(valueList{l, dimension})
+		// Values identical to the median may end up on either side, the
+		// searches below allow for that. Keeping the median in the middle
+		// keeps the tree balanced when many photons lie on the same plane.
 		median := len(l) / 2
-		// Adjust the median to make sure it's the FIRST of any
-		// identical values
-		dimension := depth % maxDimension
-		forbiddenValue := comparingValue(l[median], dimension)
-		for comparingValue(l[median], dimension) == forbiddenValue && median > 0 {
-			median--
-		}
 		value := l[median]
 
 		left := make(chan *KDNode, 1)
 		right := make(chan *KDNode, 1)
 
 		// Branch if high enough in the tree
-		condGo(depth < 4, func() { create(l[:median], left, depth+1) })
-		create(l[median+1:], right, depth+1)
+		condGo(depth < 4, func() { create(l[:median], offset, left, depth+1) })
+		create(l[median+1:], offset+median+1, right, depth+1)
 
-		result <- &KDNode{value, depth % maxDimension, <-left, <-right}
+		node := &nodes[offset+median]
+		*node = KDNode{value.Position(), value, dimension, <-left, <-right}
+		result <- node
 	}
 	node := make(chan *KDNode, 1)
-	create(items, node, 0)
+	create(items, 0, node, 0)
 	return <-node
 }
 
+// Returns the dimension in which the items are spread the widest
+func widestDimension(items []Item, maxDimension int) int {
+	first := items[0].Position()
+	var min, max [3]geometry.Float
+	for dimension := 0; dimension < maxDimension; dimension++ {
+		min[dimension] = comparingValue(first, dimension)
+		max[dimension] = min[dimension]
+	}
+	for _, item := range items {
+		position := item.Position()
+		for dimension := 0; dimension < maxDimension; dimension++ {
+			value := comparingValue(position, dimension)
+			if value < min[dimension] {
+				min[dimension] = value
+			}
+			if value > max[dimension] {
+				max[dimension] = value
+			}
+		}
+	}
+
+	widest := 0
+	for dimension := 1; dimension < maxDimension; dimension++ {
+		if max[dimension]-min[dimension] > max[widest]-min[widest] {
+			widest = dimension
+		}
+	}
+	return widest
+}
+
 // Searches the tree for any nodes within radius r
 // from the target point. This is currently rather slow
 // but accurate. By comparing every point to the leftmost
@@ -177,3 +251,89 @@ func (tree *KDNode) neighbors(point geometry.Vec3, r geometry.Float, result []*K
 	// Return all the found nodes
 	return result
 }
+
+// A max-heap on the distance to the search point, so the farthest of the
+// nearest nodes found so far can be replaced cheaply.
+type nodeHeap struct {
+	nodes     []*KDNode
+	distances []geometry.Float
+}
+
+func (h *nodeHeap) Len() int {
+	return len(h.nodes)
+}
+
+func (h *nodeHeap) Less(i, j int) bool {
+	return h.distances[i] > h.distances[j]
+}
+
+func (h *nodeHeap) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
+	h.distances[i], h.distances[j] = h.distances[j], h.distances[i]
+}
+
+func (h *nodeHeap) Push(x interface{}) {
+	panic("use add")
+}
+
+func (h *nodeHeap) Pop() interface{} {
+	last := len(h.nodes) - 1
+	node := h.nodes[last]
+	h.nodes, h.distances = h.nodes[:last], h.distances[:last]
+	return node
+}
+
+func (h *nodeHeap) add(node *KDNode, distance2 geometry.Float) {
+	h.nodes = append(h.nodes, node)
+	h.distances = append(h.distances, distance2)
+	heap.Fix(h, len(h.nodes)-1)
+}
+
+// Searches the tree for the k nodes closest to point that lie within
+// radius r. Returns the nodes and the squared search radius that encloses
+// them, which is r² unless k nodes were found.
+func (tree *KDNode) Nearest(point geometry.Vec3, k int, r geometry.Float) ([]*KDNode, geometry.Float) {
+	found := &nodeHeap{make([]*KDNode, 0, k), make([]geometry.Float, 0, k)}
+	tree.nearest(point, k, r*r, found)
+	if k > 0 && len(found.nodes) == k {
+		return found.nodes, found.distances[0]
+	}
+	return found.nodes, r * r
+}
+
+func (tree *KDNode) nearest(point geometry.Vec3, k int, r2 geometry.Float, found *nodeHeap) {
+	if tree == nil || k <= 0 {
+		return
+	}
+
+	// Shrink the search to the farthest node once k have been found
+	if len(found.nodes) == k {
+		r2 = found.distances[0]
+	}
+
+	if distance2 := tree.Distance2(point); distance2 < r2 {
+		if len(found.nodes) == k {
+			heap.Pop(found)
+		}
+		found.add(tree, distance2)
+		if len(found.nodes) == k {
+			r2 = found.distances[0]
+		}
+	}
+
+	// Search the side of the split containing the point first, the other
+	// side only if the sphere crosses the splitting plane
+	split := tree.Split
+	delta := comparingValue(point, split) - comparingValue(tree.Position, split)
+	near, far := tree.Left, tree.Right
+	if delta > 0 {
+		near, far = tree.Right, tree.Left
+	}
+	near.nearest(point, k, r2, found)
+	if len(found.nodes) == k {
+		r2 = found.distances[0]
+	}
+	if delta*delta < r2 {
+		far.nearest(point, k, r2, found)
+	}
+}
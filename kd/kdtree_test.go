@@ -0,0 +1,114 @@
+package kd
+
+import (
+	"github.com/Nightgunner5/goray/geometry"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Returns the sorted squared distances of nodes to point
+func distances2(nodes []*KDNode, point geometry.Vec3) []float64 {
+	var result []float64
+	for _, node := range nodes {
+		result = append(result, float64(node.Distance2(point)))
+	}
+	sort.Float64s(result)
+	return result
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
+
+func TestNearest(t *testing.T) {
+	var line []geometry.Vec3
+	for x := 0; x < 10; x++ {
+		line = append(line, geometry.Vec3{geometry.Float(x), 0, 0})
+	}
+	tree := New(line, 3)
+
+	tests := []struct {
+		point     geometry.Vec3
+		k         int
+		r         geometry.Float
+		distances []float64 // Squared, sorted
+		radius2   float64
+	}{
+		{geometry.Vec3{2.2, 0, 0}, 3, 10, []float64{0.04, 0.64, 1.44}, 1.44},
+		// Fewer than k within the radius
+		{geometry.Vec3{2.2, 0, 0}, 3, 1, []float64{0.04, 0.64}, 1},
+		{geometry.Vec3{2, 3, 0}, 2, 3.5, []float64{9, 10}, 10},
+		{geometry.Vec3{-5, 0, 0}, 4, 2, nil, 4},
+		{geometry.Vec3{4, 0, 0}, 1, 10, []float64{0}, 0},
+		{geometry.Vec3{4, 0, 0}, 0, 10, nil, 100},
+	}
+	for _, test := range tests {
+		nodes, radius2 := tree.Nearest(test.point, test.k, test.r)
+		found := distances2(nodes, test.point)
+		ok := len(found) == len(test.distances) && closeTo(float64(radius2), test.radius2)
+		for i := 0; ok && i < len(found); i++ {
+			ok = closeTo(found[i], test.distances[i])
+		}
+		if !ok {
+			t.Errorf("Nearest(%v, %v, %v) found distances² %v and radius² %v, want %v and %v",
+				test.point, test.k, test.r, found, radius2, test.distances, test.radius2)
+		}
+	}
+
+	var empty *KDNode
+	if nodes, radius2 := empty.Nearest(geometry.Vec3{}, 3, 2); len(nodes) != 0 || radius2 != 4 {
+		t.Errorf("Nearest in an empty tree found %v nodes and radius² %v, want 0 and 4", len(nodes), radius2)
+	}
+}
+
+// Compares Nearest to checking every point of a random cloud
+func TestNearestBruteForce(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomVec3 := func() geometry.Vec3 {
+		return geometry.Vec3{geometry.Float(random.Float64()), geometry.Float(random.Float64()), geometry.Float(random.Float64())}
+	}
+	var cloud []geometry.Vec3
+	for i := 0; i < 1000; i++ {
+		cloud = append(cloud, randomVec3())
+	}
+	tree := New(cloud, 3)
+
+	tests := []struct {
+		k int
+		r geometry.Float
+	}{
+		{1, 1},
+		{8, 0.2},
+		{32, 0.1},
+		{32, 2},
+		{2000, 0.3},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			point := randomVec3()
+			var want []float64
+			for _, p := range cloud {
+				if d := float64(p.Distance2(point)); d < float64(test.r*test.r) {
+					want = append(want, d)
+				}
+			}
+			sort.Float64s(want)
+			if len(want) > test.k {
+				want = want[:test.k]
+			}
+
+			nodes, _ := tree.Nearest(point, test.k, test.r)
+			found := distances2(nodes, point)
+			ok := len(found) == len(want)
+			for i := 0; ok && i < len(found); i++ {
+				ok = found[i] == want[i]
+			}
+			if !ok {
+				t.Errorf("Nearest(%v, %v, %v) found distances² %v, want %v", point, test.k, test.r, found, want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package ldr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+////////////////////////
+// Windows bitmap
+////////////////////////
+
+// Writes img as an uncompressed 24 bit BMP file, which holds 8 bits per
+// channel only
+func EncodeBMP(w io.Writer, img image.Image) error {
+	out := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	// Every row is padded to a multiple of 4 bytes
+	stride := (3*width + 3) &^ 3
+	const headers = 14 + 40
+
+	// File header
+	out.WriteString("BM")
+	binary.Write(out, le, uint32(headers+stride*height))
+	binary.Write(out, le, uint32(0)) // Reserved
+	binary.Write(out, le, uint32(headers))
+
+	// BITMAPINFOHEADER
+	binary.Write(out, le, uint32(40))
+	binary.Write(out, le, [2]int32{int32(width), int32(height)})
+	binary.Write(out, le, [2]uint16{1, 24}) // Planes, bits per pixel
+	binary.Write(out, le, [2]uint32{0, uint32(stride * height)})
+	binary.Write(out, le, [2]int32{2835, 2835}) // 72 dpi in pixels per metre
+	binary.Write(out, le, [2]uint32{0, 0})      // Palette colours
+
+	// Rows are stored from the bottom, pixels in blue, green, red order
+	row := make([]byte, stride)
+	for y := height - 1; y >= 0; y-- {
+		for x := 0; x < width; x++ {
+			r, g, b := rgb(img, x, y)
+			row[3*x], row[3*x+1], row[3*x+2] = byte(b>>8), byte(g>>8), byte(r>>8)
+		}
+		out.Write(row)
+	}
+	return out.Flush()
+}
@@ -0,0 +1,27 @@
+package ldr
+
+import (
+	"image"
+	"image/color"
+)
+
+////////////////////////
+// Display images
+////////////////////////
+
+// Whether img has more than 8 bits per channel
+func deep(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// Returns the 16 bit colour of pixel x, y of img, counting from its origin,
+// without alpha
+func rgb(img image.Image, x, y int) (r, g, b uint16) {
+	bounds := img.Bounds()
+	r32, g32, b32, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+	return uint16(r32), uint16(g32), uint16(b32)
+}
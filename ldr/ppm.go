@@ -0,0 +1,35 @@
+package ldr
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+)
+
+////////////////////////
+// Portable pixmap
+////////////////////////
+
+// Writes img as a binary PPM file, with 16 bit big endian values if it has
+// more than 8 bits per channel
+func EncodePPM(w io.Writer, img image.Image) error {
+	out := bufio.NewWriter(w)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	maxValue := 255
+	if deep(img) {
+		maxValue = 65535
+	}
+	fmt.Fprintf(out, "P6\n%v %v\n%v\n", width, height, maxValue)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b := rgb(img, x, y)
+			if maxValue == 255 {
+				out.Write([]byte{byte(r >> 8), byte(g >> 8), byte(b >> 8)})
+			} else {
+				out.Write([]byte{byte(r >> 8), byte(r), byte(g >> 8), byte(g), byte(b >> 8), byte(b)})
+			}
+		}
+	}
+	return out.Flush()
+}
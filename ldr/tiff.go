@@ -0,0 +1,92 @@
+package ldr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+////////////////////////
+// TIFF
+////////////////////////
+
+// The types of TIFF fields used here
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+// Writes img as an uncompressed baseline RGB TIFF file in a single strip,
+// with 16 bits per channel if it has more than 8
+func EncodeTIFF(w io.Writer, img image.Image) error {
+	out := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	bits := 8
+	if deep(img) {
+		bits = 16
+	}
+
+	// The directory follows the header, and the values that don't fit in
+	// its entries and the pixels follow the directory
+	type entry struct {
+		tag, kind    uint16
+		count, value uint32
+	}
+	const (
+		entries   = 13
+		directory = 8
+		bitsAt    = directory + 2 + 12*entries + 4
+		xResAt    = bitsAt + 8
+		yResAt    = xResAt + 8
+		pixelsAt  = yResAt + 8
+	)
+	size := uint32(width * height * 3 * bits / 8)
+	directoryEntries := [entries]entry{
+		{256, tiffLong, 1, uint32(width)},
+		{257, tiffLong, 1, uint32(height)},
+		{258, tiffShort, 3, bitsAt},        // Bits per sample
+		{259, tiffShort, 1, 1},             // No compression
+		{262, tiffShort, 1, 2},             // RGB
+		{273, tiffLong, 1, pixelsAt},       // Strip offsets
+		{277, tiffShort, 1, 3},             // Samples per pixel
+		{278, tiffLong, 1, uint32(height)}, // Rows per strip
+		{279, tiffLong, 1, size},           // Strip byte counts
+		{282, tiffRational, 1, xResAt},
+		{283, tiffRational, 1, yResAt},
+		{284, tiffShort, 1, 1}, // Chunky planar configuration
+		{296, tiffShort, 1, 2}, // Resolution in inches
+	}
+
+	out.WriteString("II")
+	binary.Write(out, le, uint16(42))
+	binary.Write(out, le, uint32(directory))
+	binary.Write(out, le, uint16(entries))
+	for _, e := range directoryEntries {
+		binary.Write(out, le, [2]uint16{e.tag, e.kind})
+		binary.Write(out, le, e.count)
+		// Short values are stored in the first half of the field
+		if e.kind == tiffShort && e.count == 1 {
+			binary.Write(out, le, [2]uint16{uint16(e.value), 0})
+		} else {
+			binary.Write(out, le, e.value)
+		}
+	}
+	binary.Write(out, le, uint32(0)) // No further directories
+	binary.Write(out, le, [4]uint16{uint16(bits), uint16(bits), uint16(bits), 0})
+	binary.Write(out, le, [4]uint32{72, 1, 72, 1})
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b := rgb(img, x, y)
+			if bits == 8 {
+				out.Write([]byte{byte(r >> 8), byte(g >> 8), byte(b >> 8)})
+			} else {
+				binary.Write(out, le, [3]uint16{r, g, b})
+			}
+		}
+	}
+	return out.Flush()
+}